@@ -0,0 +1,103 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+)
+
+// AsyncFullPolicy decides what to do when the queue for AsyncEmit is full.
+type AsyncFullPolicy int
+
+const (
+	// AsyncFullBlock makes Handle wait until the queue has room.
+	AsyncFullBlock AsyncFullPolicy = iota
+	// AsyncFullDropOldest drops the oldest record in the queue.
+	AsyncFullDropOldest
+	// AsyncFullDropNew drops the record being handled.
+	AsyncFullDropNew
+)
+
+type asyncItem struct {
+	ctx     context.Context
+	handler slog.Handler
+	r       slog.Record
+}
+
+// startAsyncEmitter starts the goroutine passing the queued records to
+// the wrapped handlers. It handles the records queued before Close, and
+// exits.
+func (h *DedupHandler) startAsyncEmitter() {
+	h.queue = make(chan asyncItem, h.opts.AsyncQueueSize)
+	h.asyncDone = make(chan struct{})
+	go func() {
+		defer close(h.asyncDone)
+		for {
+			select {
+			case item := <-h.queue:
+				h.emitAsyncItem(item)
+			case <-h.lifetimeCtx.Done():
+				for {
+					select {
+					case item := <-h.queue:
+						h.emitAsyncItem(item)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (h *DedupHandler) emitAsyncItem(item asyncItem) {
+	if err := item.handler.Handle(item.ctx, item.r); err != nil {
+		h.lock()
+		h.stats.AsyncErrors += 1
+		h.unlock()
+	}
+}
+
+// enqueue queues r to be passed to handler according to AsyncFullPolicy.
+func (h *DedupHandler) enqueue(ctx context.Context, handler slog.Handler, r slog.Record) error {
+	// ctx may be canceled after Handle returns.
+	item := asyncItem{ctx: context.WithoutCancel(ctx), handler: handler, r: r.Clone()}
+	// The emitter exits after the handler is stopped,
+	// e.g. while flushing for FlushOnShutdown.
+	if h.lifetimeCtx.Err() != nil {
+		return handler.Handle(item.ctx, item.r)
+	}
+	switch h.opts.AsyncFullPolicy {
+	case AsyncFullDropOldest:
+		for {
+			select {
+			case h.queue <- item:
+				return nil
+			default:
+			}
+			select {
+			case <-h.queue:
+				h.countAsyncDropped()
+			default:
+			}
+		}
+	case AsyncFullDropNew:
+		select {
+		case h.queue <- item:
+		default:
+			h.countAsyncDropped()
+		}
+	default:
+		select {
+		case h.queue <- item:
+		case <-h.lifetimeCtx.Done():
+			return handler.Handle(item.ctx, item.r)
+		}
+	}
+	return nil
+}
+
+func (h *DedupHandler) countAsyncDropped() {
+	h.lock()
+	h.stats.AsyncDropped += 1
+	h.unlock()
+}
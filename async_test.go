@@ -0,0 +1,138 @@
+package deduplog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gateHandler records the messages, blocking the first Handle until
+// unblock is closed.
+type gateHandler struct {
+	slog.Handler
+	entered chan struct{}
+	unblock chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	msgs    []string
+}
+
+func newGateHandler() *gateHandler {
+	return &gateHandler{
+		Handler: slog.NewJSONHandler(io.Discard, nil),
+		entered: make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+}
+
+func (h *gateHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.once.Do(func() {
+		close(h.entered)
+		<-h.unblock
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.msgs = append(h.msgs, r.Message)
+	return nil
+}
+
+func (h *gateHandler) messages() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.msgs...)
+}
+
+func TestAsyncEmit(t *testing.T) {
+	testCases := []struct {
+		policy AsyncFullPolicy
+		want   []string
+	}{
+		{policy: AsyncFullDropNew, want: []string{"msg0", "msg1", "msg2"}},
+		{policy: AsyncFullDropOldest, want: []string{"msg0", "msg3", "msg4"}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("policy=%d", tc.policy), func(t *testing.T) {
+			gh := newGateHandler()
+			h := NewDedupHandler(context.Background(), gh,
+				&HandlerOptions{
+					HistoryRetentionPeriod: time.Minute,
+					MaxHistoryCount:        DefaultMaxHistoryCount,
+					AsyncEmit:              true,
+					AsyncQueueSize:         2,
+					AsyncFullPolicy:        tc.policy,
+				})
+			defer h.Close()
+			logger := slog.New(h)
+
+			logger.Info("msg0")
+			// The emitter is blocked in the wrapped handler.
+			<-gh.entered
+			for i := 1; i < 5; i++ {
+				logger.Info(fmt.Sprintf("msg%d", i))
+			}
+			// The duplicate is suppressed without being queued.
+			logger.Info("msg1")
+			assert.Equal(t, int64(2), h.Stats().AsyncDropped)
+
+			close(gh.unblock)
+			require.Eventually(t, func() bool {
+				return len(gh.messages()) == 3
+			}, time.Second, time.Millisecond)
+			assert.Equal(t, tc.want, gh.messages())
+		})
+	}
+}
+
+func TestAsyncEmitBlock(t *testing.T) {
+	gh := newGateHandler()
+	h := NewDedupHandler(context.Background(), gh,
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			AsyncEmit:              true,
+			AsyncQueueSize:         1,
+		})
+	logger := slog.New(h)
+
+	logger.Info("msg0")
+	<-gh.entered
+	logger.Info("msg1")
+	done := make(chan struct{})
+	go func() {
+		logger.Info("msg2")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Handle should block while the queue is full")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(gh.unblock)
+	<-done
+	// Close waits for the queued records.
+	require.NoError(t, h.Close())
+	assert.Equal(t, []string{"msg0", "msg1", "msg2"}, gh.messages())
+	assert.Equal(t, int64(0), h.Stats().AsyncDropped)
+}
+
+func TestAsyncEmitUnsynchronized(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			AsyncEmit:              true,
+			Unsynchronized:         true,
+		})
+	defer h.Close()
+	// AsyncEmit is disabled so that Stats is not updated concurrently.
+	assert.False(t, h.Config().AsyncEmit)
+	assert.Nil(t, h.queue)
+}
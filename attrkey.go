@@ -0,0 +1,81 @@
+package deduplog
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// attrsKey returns the canonical form of the attributes of r for the key.
+// The attributes are flattened with the group names joined by ".", sorted
+// by the key, and formatted as "key=value" separated by "\x00". The values
+// are formatted as follows, so that the logically equal values are equal:
+//   - numbers and strings of them in the shortest decimal form, like "1"
+//     for int 1, float 1.0 and string "1"
+//   - times in RFC3339 with nanoseconds in UTC
+//   - durations like "1.5s"
+//   - the other values by fmt.Sprint after resolving slog.LogValuer
+func attrsKey(r slog.Record) string {
+	var kvs []string
+	r.Attrs(func(a slog.Attr) bool {
+		kvs = appendCanonicalAttr(kvs, "", a)
+		return true
+	})
+	sort.Strings(kvs)
+	return strings.Join(kvs, "\x00")
+}
+
+// attrsHash returns the hash of attrsKey(r).
+func attrsHash(r slog.Record) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(attrsKey(r)))
+	return f.Sum64()
+}
+
+func appendCanonicalAttr(kvs []string, prefix string, a slog.Attr) []string {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			kvs = appendCanonicalAttr(kvs, prefix, ga)
+		}
+		return kvs
+	}
+	if a.Key == "" {
+		return kvs
+	}
+	return append(kvs, prefix+a.Key+"="+canonicalValue(v))
+}
+
+func canonicalValue(v slog.Value) string {
+	switch v.Kind() {
+	case slog.KindInt64:
+		return strconv.FormatInt(v.Int64(), 10)
+	case slog.KindUint64:
+		return strconv.FormatUint(v.Uint64(), 10)
+	case slog.KindFloat64:
+		return canonicalFloat(v.Float64())
+	case slog.KindString:
+		s := v.String()
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return canonicalFloat(f)
+		}
+		return s
+	case slog.KindTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	case slog.KindDuration:
+		return v.Duration().String()
+	default:
+		return fmt.Sprint(v.Any())
+	}
+}
+
+func canonicalFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
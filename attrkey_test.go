@@ -0,0 +1,135 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttrsKey(t *testing.T) {
+	tm := time.Date(2024, 1, 2, 3, 4, 5, 6, time.FixedZone("JST", 9*60*60))
+	testCases := []struct {
+		name  string
+		attrs []slog.Attr
+		other []slog.Attr
+		equal bool
+	}{
+		{
+			name:  "order",
+			attrs: []slog.Attr{slog.String("a", "x"), slog.String("b", "y")},
+			other: []slog.Attr{slog.String("b", "y"), slog.String("a", "x")},
+			equal: true,
+		},
+		{
+			name:  "int and string",
+			attrs: []slog.Attr{slog.Int("key", 1)},
+			other: []slog.Attr{slog.String("key", "1")},
+			equal: true,
+		},
+		{
+			name:  "int and float",
+			attrs: []slog.Attr{slog.Int("key", 1)},
+			other: []slog.Attr{slog.Float64("key", 1.0)},
+			equal: true,
+		},
+		{
+			name:  "uint and string",
+			attrs: []slog.Attr{slog.Uint64("key", 10)},
+			other: []slog.Attr{slog.String("key", "10.0")},
+			equal: true,
+		},
+		{
+			name:  "time zone",
+			attrs: []slog.Attr{slog.Time("key", tm)},
+			other: []slog.Attr{slog.Time("key", tm.UTC())},
+			equal: true,
+		},
+		{
+			name:  "group",
+			attrs: []slog.Attr{slog.Group("g", slog.Int("a", 1), slog.Int("b", 2))},
+			other: []slog.Attr{slog.Group("g", slog.Int("b", 2), slog.Int("a", 1))},
+			equal: true,
+		},
+		{
+			name:  "different values",
+			attrs: []slog.Attr{slog.Int("key", 1)},
+			other: []slog.Attr{slog.Int("key", 2)},
+			equal: false,
+		},
+		{
+			name:  "different keys",
+			attrs: []slog.Attr{slog.Int("a", 1)},
+			other: []slog.Attr{slog.Int("b", 1)},
+			equal: false,
+		},
+		{
+			name:  "group and flat",
+			attrs: []slog.Attr{slog.Group("g", slog.Int("a", 1))},
+			other: []slog.Attr{slog.Int("a", 1)},
+			equal: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r1 := slog.NewRecord(time.Now(), slog.LevelInfo, "test", 0)
+			r1.AddAttrs(tc.attrs...)
+			r2 := slog.NewRecord(time.Now(), slog.LevelInfo, "test", 0)
+			r2.AddAttrs(tc.other...)
+			if tc.equal {
+				assert.Equal(t, attrsKey(r1), attrsKey(r2))
+			} else {
+				assert.NotEqual(t, attrsKey(r1), attrsKey(r2))
+			}
+		})
+	}
+}
+
+func TestKeyByMessageAndAttrs(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			KeyByMessageAndAttrs:   true,
+		}))
+
+	logger.Info("test", "id", 1, "user", "alice")
+	logger.Info("test", "user", "alice", "id", "1")
+	logger.Info("test", "user", "bob", "id", 1)
+
+	assert.Equal(t, 2, bytes.Count(b.Bytes(), []byte("\n")))
+}
+
+func TestEmitOnAttrChange(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			EmitOnAttrChange:       true,
+		}))
+	countLines := func() int {
+		n := bytes.Count(b.Bytes(), []byte("\n"))
+		b.Reset()
+		return n
+	}
+
+	logger.Info("status", "state", "up")
+	logger.Info("status", "state", "up")
+	assert.Equal(t, 1, countLines())
+
+	logger.Info("status", "state", "down")
+	logger.Info("status", "state", "down")
+	logger.Info("status", "state", "down")
+	assert.Equal(t, 1, countLines())
+
+	// Compared with the last emitted record.
+	logger.Info("status", "state", "up")
+	assert.Equal(t, 1, countLines())
+	logger.Info("status", "state", "up")
+	assert.Equal(t, 0, countLines())
+}
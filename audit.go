@@ -0,0 +1,33 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+)
+
+const (
+	AuditMessage         = "dedup.suppressed"
+	AuditOriginalMsgKey  = "original_msg"
+	AuditKeyKey          = "key"
+	AuditSuppressedAtKey = "suppressed_at"
+)
+
+// audit passes a record of the suppression of r to AuditHandler.
+// The errors are counted in Stats.AuditErrors instead of being returned.
+func (h *DedupHandler) audit(ctx context.Context, key string, r slog.Record) {
+	if h.opts.AuditHandler == nil {
+		return
+	}
+	now := h.now()
+	ar := h.newSyntheticRecord(now, r.Level, AuditMessage)
+	ar.AddAttrs(
+		slog.String(AuditOriginalMsgKey, r.Message),
+		slog.String(AuditKeyKey, key),
+		slog.Time(AuditSuppressedAtKey, now),
+	)
+	if err := h.opts.AuditHandler.Handle(ctx, ar); err != nil {
+		h.lock()
+		h.stats.AuditErrors += 1
+		h.unlock()
+	}
+}
@@ -0,0 +1,71 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditHandler(t *testing.T) {
+	b := new(bytes.Buffer)
+	ab := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			AuditHandler:           slog.NewJSONHandler(ab, nil),
+		}))
+
+	logger.Info("foo")
+	logger.Info("foo")
+	logger.Info("bar")
+	logger.Info("foo")
+	logger.Info("bar")
+
+	lines := bytes.Split(bytes.TrimSpace(ab.Bytes()), []byte("\n"))
+	require.Len(t, lines, 3)
+	msgs := []string{}
+	for _, line := range lines {
+		jsonLog := make(map[string]any)
+		require.NoError(t, json.Unmarshal(line, &jsonLog))
+		assert.Equal(t, AuditMessage, jsonLog["msg"])
+		assert.Equal(t, jsonLog[AuditOriginalMsgKey], jsonLog[AuditKeyKey])
+		assert.Contains(t, jsonLog, AuditSuppressedAtKey)
+		msgs = append(msgs, jsonLog[AuditOriginalMsgKey].(string))
+	}
+	assert.Equal(t, []string{"foo", "foo", "bar"}, msgs)
+}
+
+// errHandler returns err from Handle.
+type errHandler struct {
+	slog.Handler
+	err error
+}
+
+func (h errHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.err
+}
+
+func TestAuditHandlerErrors(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			AuditHandler:           errHandler{slog.NewJSONHandler(io.Discard, nil), errors.New("audit failure")},
+		})
+	logger := slog.New(h)
+
+	logger.Info("foo")
+	logger.Info("foo")
+	logger.Info("foo")
+
+	assert.Equal(t, int64(2), h.Stats().AuditErrors)
+}
@@ -0,0 +1,133 @@
+package deduplog
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"time"
+)
+
+type bloomFilter struct {
+	bits      []uint64
+	bitCount  uint64
+	hashCount int
+}
+
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	bitCount := uint64(max(m, 64))
+	return &bloomFilter{
+		bits:      make([]uint64, (bitCount+63)/64),
+		bitCount:  bitCount,
+		hashCount: max(k, 1),
+	}
+}
+
+// positions calls f with the bit positions of key
+// computed by double hashing.
+func (b *bloomFilter) positions(key string, f func(uint64) bool) {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	h1 := mix64(hash.Sum64())
+	h2 := mix64(h1) | 1
+	for i := 0; i < b.hashCount; i++ {
+		if !f((h1 + uint64(i)*h2) % b.bitCount) {
+			return
+		}
+	}
+}
+
+// mix64 is the finalizer of SplitMix64 to spread the bits of FNV hashes.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (b *bloomFilter) contains(key string) bool {
+	found := true
+	b.positions(key, func(pos uint64) bool {
+		found = b.bits[pos/64]&(1<<(pos%64)) != 0
+		return found
+	})
+	return found
+}
+
+func (b *bloomFilter) add(key string) {
+	b.positions(key, func(pos uint64) bool {
+		b.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+}
+
+// rotatingBloomFilter remembers the keys added in the current and
+// the previous periods.
+type rotatingBloomFilter struct {
+	current    *bloomFilter
+	previous   *bloomFilter
+	n          int
+	p          float64
+	rotateTime time.Time
+}
+
+func newRotatingBloomFilter(n int, p float64, now time.Time) *rotatingBloomFilter {
+	return &rotatingBloomFilter{
+		current:    newBloomFilter(n, p),
+		previous:   newBloomFilter(n, p),
+		n:          n,
+		p:          p,
+		rotateTime: now,
+	}
+}
+
+func (rb *rotatingBloomFilter) rotate(now time.Time, period time.Duration) {
+	elapsed := now.Sub(rb.rotateTime)
+	if elapsed < period {
+		return
+	}
+	if elapsed < period*2 {
+		rb.previous = rb.current
+	} else {
+		rb.previous = newBloomFilter(rb.n, rb.p)
+	}
+	rb.current = newBloomFilter(rb.n, rb.p)
+	rb.rotateTime = now
+}
+
+func (rb *rotatingBloomFilter) contains(key string) bool {
+	return rb.current.contains(key) || rb.previous.contains(key)
+}
+
+func (h *DedupHandler) handleApproximately(ctx context.Context, key string, r slog.Record) (bool, Reason, error) {
+	eligible := h.dedupEligible(ctx, r)
+	h.lock()
+	h.filters.rotate(h.monotonicNow(), h.opts.HistoryRetentionPeriod)
+	reason := ReasonBypassed
+	if eligible {
+		dup := h.filters.contains(key)
+		h.hits.record(h.now(), dup)
+		if dup {
+			h.stats.Suppressed += 1
+			h.metrics.IncSuppressed()
+			h.stats.SuppressedByLevel[r.Level] += 1
+			h.unlock()
+			return false, ReasonSuppressedDuplicate, h.overflow(ctx, key, r)
+		}
+		reason = ReasonEmitted
+	}
+	if !h.allowEmit() {
+		h.stats.Throttled += 1
+		h.unlock()
+		return false, ReasonThrottled, h.dryRunEmit(ctx, r)
+	}
+	h.filters.current.add(key)
+	h.stats.Emitted += 1
+	h.metrics.IncEmitted()
+	h.unlock()
+	return true, reason, h.emit(ctx, withAddedAttrs(r, h.keyHashAttrs(key)...))
+}
@@ -0,0 +1,70 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApproximateMode(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			ApproximateMode:        true,
+			ExpectedCardinality:    1000,
+			FalsePositiveRate:      0.001,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	for i := 0; i < 500; i++ {
+		logger.Info(fmt.Sprintf("test%d", i))
+	}
+	emitted := h.Stats().Emitted
+	assert.Greater(t, emitted, int64(495))
+
+	// The known duplicates are always suppressed.
+	for i := 0; i < 500; i++ {
+		logger.Info(fmt.Sprintf("test%d", i))
+	}
+	assert.Equal(t, emitted, h.Stats().Emitted)
+
+	// The unseen messages are almost always emitted within the capacity.
+	for i := 500; i < 1000; i++ {
+		logger.Info(fmt.Sprintf("test%d", i))
+	}
+	assert.Greater(t, h.Stats().Emitted-emitted, int64(495))
+
+	// The messages are forgotten after two periods.
+	now = now.Add(time.Minute * 2)
+	b.Reset()
+	logger.Info("test0")
+	assert.NotEmpty(t, b.String())
+}
+
+func TestApproximateModeDerivedHandlers(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch,
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			ApproximateMode:        true,
+		})
+	defer h.Close()
+	logger := slog.New(h)
+
+	// The derived handlers share the filters instead of allocating theirs.
+	derived := logger.With("request_id", 1)
+	assert.Same(t, h.filters, derived.Handler().(*DedupHandler).filters)
+
+	logger.Info("foo")
+	derived.Info("foo")
+	logger.With("request_id", 2).Info("foo")
+	assert.Equal(t, 1, ch.counts["foo"])
+}
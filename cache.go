@@ -0,0 +1,57 @@
+package deduplog
+
+// Cache stores the history of a DedupHandler. The handler calls the methods
+// with its lock held, so they need not be safe for concurrent use unless
+// the Cache is shared. The handler evicts the entries by itself to keep
+// MaxHistoryCount. If the Cache also evicts the entries by itself, their
+// summaries are lost.
+type Cache interface {
+	// Get returns the entry for key.
+	Get(key string) (*HistoryEntry, bool)
+	// Set stores e for key.
+	Set(key string, e *HistoryEntry)
+	// Delete removes the entry for key.
+	Delete(key string)
+	// Len returns the number of the entries.
+	Len() int
+	// Range calls f for each entry until f returns false.
+	// f does not modify the Cache.
+	Range(f func(key string, e *HistoryEntry) bool)
+}
+
+// mapCache is the built-in Cache.
+type mapCache map[string]*HistoryEntry
+
+func (c mapCache) Get(key string) (*HistoryEntry, bool) {
+	e, ok := c[key]
+	return e, ok
+}
+
+func (c mapCache) Set(key string, e *HistoryEntry) {
+	c[key] = e
+}
+
+func (c mapCache) Delete(key string) {
+	delete(c, key)
+}
+
+func (c mapCache) Len() int {
+	return len(c)
+}
+
+func (c mapCache) Range(f func(key string, e *HistoryEntry) bool) {
+	for k, v := range c {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// newCache creates the Cache for the history. capacity is the capacity
+// hint for the built-in map.
+func (h *DedupHandler) newCache(capacity int) Cache {
+	if h.opts.NewCache != nil {
+		return h.opts.NewCache()
+	}
+	return make(mapCache, capacity)
+}
@@ -0,0 +1,93 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sliceCache is a Cache keeping the entries in insertion order.
+type sliceCache struct {
+	keys    []string
+	entries []*HistoryEntry
+	sets    int
+}
+
+func (c *sliceCache) Get(key string) (*HistoryEntry, bool) {
+	if i := slices.Index(c.keys, key); i >= 0 {
+		return c.entries[i], true
+	}
+	return nil, false
+}
+
+func (c *sliceCache) Set(key string, e *HistoryEntry) {
+	c.sets += 1
+	if i := slices.Index(c.keys, key); i >= 0 {
+		c.entries[i] = e
+		return
+	}
+	c.keys = append(c.keys, key)
+	c.entries = append(c.entries, e)
+}
+
+func (c *sliceCache) Delete(key string) {
+	if i := slices.Index(c.keys, key); i >= 0 {
+		c.keys = slices.Delete(c.keys, i, i+1)
+		c.entries = slices.Delete(c.entries, i, i+1)
+	}
+}
+
+func (c *sliceCache) Len() int {
+	return len(c.keys)
+}
+
+func (c *sliceCache) Range(f func(key string, e *HistoryEntry) bool) {
+	for i, k := range c.keys {
+		if !f(k, c.entries[i]) {
+			return
+		}
+	}
+}
+
+func TestNewCache(t *testing.T) {
+	b := new(bytes.Buffer)
+	var caches []*sliceCache
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        2,
+			NewCache: func() Cache {
+				c := &sliceCache{}
+				caches = append(caches, c)
+				return c
+			},
+		})
+	logger := slog.New(h)
+
+	logger.Info("foo")
+	logger.Info("foo")
+	logger.Info("bar")
+	logger.Info("baz")
+	logger.Info("bar")
+	// "foo" was evicted.
+	logger.Info("foo")
+
+	assert.Equal(t, 4, bytes.Count(b.Bytes(), []byte("\n")))
+	assert.Len(t, caches, 1)
+	assert.Equal(t, []string{"baz", "foo"}, caches[0].keys)
+	assert.Equal(t, 4, caches[0].sets)
+
+	// The derived handlers share the cache.
+	logger.With("key", "value").Info("foo")
+	assert.Equal(t, 4, bytes.Count(b.Bytes(), []byte("\n")))
+	assert.Len(t, caches, 1)
+
+	h.Reset()
+	assert.Len(t, caches, 2)
+	assert.Equal(t, 0, h.history.Len())
+}
@@ -0,0 +1,93 @@
+package deduplog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// consecutiveRun is the state of ConsecutiveOnly mode.
+type consecutiveRun struct {
+	key        string
+	msg        string
+	level      slog.Level
+	started    bool
+	suppressed int
+	// firstSuppressed and lastSuppressed are the times when the first and
+	// the last records of the run were suppressed.
+	firstSuppressed time.Time
+	lastSuppressed  time.Time
+}
+
+func (h *DedupHandler) handleConsecutively(ctx context.Context, key string, r slog.Record) (bool, Reason, error) {
+	eligible := h.dedupEligible(ctx, r)
+	h.lock()
+	if h.run.started && h.run.key == key && eligible {
+		now := h.now()
+		if h.run.suppressed == 0 {
+			h.run.firstSuppressed = now
+		}
+		h.run.lastSuppressed = now
+		h.run.suppressed += 1
+		h.stats.Suppressed += 1
+		h.metrics.IncSuppressed()
+		h.stats.SuppressedByLevel[r.Level] += 1
+		h.unlock()
+		return false, ReasonSuppressedDuplicate, h.overflow(ctx, key, r)
+	}
+	if !h.allowEmit() {
+		h.stats.Throttled += 1
+		h.unlock()
+		return false, ReasonThrottled, h.dryRunEmit(ctx, r)
+	}
+	var summary *pendingSummary
+	if h.run.started && h.run.key != key {
+		summary = h.runSummary()
+	}
+	if !h.run.started || h.run.key != key {
+		h.run = consecutiveRun{key: key, msg: r.Message, level: r.Level, started: true}
+	}
+	h.stats.Emitted += 1
+	h.metrics.IncEmitted()
+	h.unlock()
+
+	reason := ReasonBypassed
+	if eligible {
+		reason = ReasonEmitted
+	}
+	r = withAddedAttrs(r, h.keyHashAttrs(key)...)
+	if summary != nil {
+		// The run may have been logged through another derived handler.
+		if err := h.root.emit(ctx, h.summaryRecord(*summary)); err != nil {
+			return true, reason, errors.Join(err, h.emit(ctx, r))
+		}
+	}
+	return true, reason, h.emit(ctx, r)
+}
+
+// runSummary returns the summary of the suppressed records of the current
+// run, or nil if there are none, and resets their count. Its message is
+// built like the one of the summaries of EmitSummary, but defaults to
+// "<msg> (repeated N times)". It must be called with the lock held.
+func (h *DedupHandler) runSummary() *pendingSummary {
+	if h.run.suppressed == 0 {
+		return nil
+	}
+	s := &pendingSummary{
+		r:         h.newSyntheticRecord(h.now(), h.run.level, ""),
+		msg:       h.run.msg,
+		count:     h.run.suppressed,
+		firstSeen: h.run.firstSuppressed,
+		lastSeen:  h.run.lastSuppressed,
+		formatter: formatRepeated,
+	}
+	h.run.suppressed = 0
+	return s
+}
+
+// formatRepeated is the default message of the summary of a run.
+func formatRepeated(msg string, count int, firstSeen, lastSeen time.Time) string {
+	return fmt.Sprintf("%s (repeated %d times)", msg, count)
+}
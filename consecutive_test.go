@@ -0,0 +1,95 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsecutiveOnly(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			ConsecutiveOnly: true,
+		}))
+	require.NotNil(t, logger)
+
+	for _, msg := range []string{"a", "a", "a", "b", "a", "a", "c", "c"} {
+		logger.Info(msg)
+	}
+
+	var msgs []string
+	for _, line := range bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n")) {
+		jsonLog := make(map[string]string)
+		require.NoError(t, json.Unmarshal(line, &jsonLog))
+		msgs = append(msgs, jsonLog["msg"])
+	}
+	assert.Equal(t, []string{
+		"a",
+		"a (repeated 2 times)",
+		"b",
+		"a",
+		"a (repeated 1 times)",
+		"c",
+	}, msgs)
+}
+
+func TestConsecutiveOnlySummaryFormat(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts HandlerOptions
+		want string
+	}{
+		{
+			name: "CountInMessage",
+			opts: HandlerOptions{CountInMessage: true},
+			want: "a (x2)",
+		},
+		{
+			name: "SummaryFormatter",
+			opts: HandlerOptions{
+				SummaryFormatter: func(msg string, count int, firstSeen, lastSeen time.Time) string {
+					return fmt.Sprintf("%s: %d more", msg, count)
+				},
+			},
+			want: "a: 2 more",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ch := newCountingHandler()
+			opts := tc.opts
+			opts.ConsecutiveOnly = true
+			logger := slog.New(NewDedupHandler(context.Background(), ch, &opts))
+
+			for _, msg := range []string{"a", "a", "a", "b"} {
+				logger.Info(msg)
+			}
+			assert.Equal(t, map[string]int{"a": 1, tc.want: 1, "b": 1}, ch.counts)
+		})
+	}
+}
+
+func TestConsecutiveOnlyFlushOnShutdown(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch,
+		&HandlerOptions{
+			ConsecutiveOnly: true,
+			FlushOnShutdown: true,
+			Unsynchronized:  true,
+		})
+	logger := slog.New(h)
+
+	for _, msg := range []string{"a", "b", "b", "b"} {
+		logger.Info(msg)
+	}
+	require.NoError(t, h.Close())
+	assert.Equal(t, map[string]int{"a": 1, "b": 1, "b (repeated 2 times)": 1}, ch.counts)
+}
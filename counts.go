@@ -0,0 +1,42 @@
+package deduplog
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+)
+
+const (
+	CountStreamMessage  = "dedup.count"
+	CountStreamKeyKey   = "key"
+	CountStreamDeltaKey = "delta"
+)
+
+// flushCounts passes the numbers of the records suppressed since
+// the previous call to CountStreamHandler.
+func (h *DedupHandler) flushCounts(ctx context.Context) error {
+	if h.opts.CountStreamHandler == nil {
+		return nil
+	}
+	h.lock()
+	deltas := h.countDeltas
+	h.countDeltas = make(map[string]uint64)
+	now := h.now()
+	h.unlock()
+
+	keys := make([]string, 0, len(deltas))
+	for k := range deltas {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var errs []error
+	for _, k := range keys {
+		r := h.newSyntheticRecord(now, slog.LevelInfo, CountStreamMessage)
+		r.AddAttrs(slog.String(CountStreamKeyKey, k), slog.Uint64(CountStreamDeltaKey, deltas[k]))
+		if err := h.opts.CountStreamHandler.Handle(ctx, r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,56 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountStreamHandler(t *testing.T) {
+	b := new(bytes.Buffer)
+	cb := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CountStreamHandler:     slog.NewJSONHandler(cb, nil),
+		})
+	logger := slog.New(h)
+	readCounts := func() map[string]float64 {
+		counts := make(map[string]float64)
+		for _, line := range bytes.Split(bytes.TrimSpace(cb.Bytes()), []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			jsonLog := make(map[string]any)
+			require.NoError(t, json.Unmarshal(line, &jsonLog))
+			assert.Equal(t, CountStreamMessage, jsonLog["msg"])
+			counts[jsonLog[CountStreamKeyKey].(string)] = jsonLog[CountStreamDeltaKey].(float64)
+		}
+		cb.Reset()
+		return counts
+	}
+
+	for i := 0; i < 3; i++ {
+		logger.Info("test1")
+	}
+	logger.Info("test2")
+	logger.Info("test2")
+	logger.Info("test3")
+	require.NoError(t, h.flushCounts(context.Background()))
+	assert.Equal(t, map[string]float64{"test1": 2, "test2": 1}, readCounts())
+	assert.NotContains(t, b.String(), CountStreamMessage)
+
+	// The deltas are reset on each tick.
+	logger.Info("test1")
+	require.NoError(t, h.flushCounts(context.Background()))
+	assert.Equal(t, map[string]float64{"test1": 1}, readCounts())
+	require.NoError(t, h.flushCounts(context.Background()))
+	assert.Empty(t, readCounts())
+}
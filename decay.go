@@ -0,0 +1,24 @@
+package deduplog
+
+import "math"
+
+// decayedScore returns the score of e decayed by DecayHalfLife
+// until now.
+func (h *DedupHandler) decayedScore(e *HistoryEntry) float64 {
+	elapsed := h.monotonicNow().Sub(e.scoreTime)
+	return e.score * math.Exp2(-float64(elapsed)/float64(h.opts.DecayHalfLife))
+}
+
+// addScore adds an occurrence to the score of e.
+func (h *DedupHandler) addScore(e *HistoryEntry) {
+	e.score = h.decayedScore(e) + 1
+	e.scoreTime = h.monotonicNow()
+}
+
+// scoreDecayed reports whether the score of e has decayed to
+// ScoreThreshold. The entries never scored, such as the ones inserted by
+// Preload, are subject only to HistoryRetentionPeriod.
+func (h *DedupHandler) scoreDecayed(e *HistoryEntry) bool {
+	return h.opts.DecayHalfLife > 0 && !e.scoreTime.IsZero() &&
+		h.decayedScore(e) <= h.opts.ScoreThreshold
+}
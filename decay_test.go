@@ -0,0 +1,77 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecayHalfLife(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod: time.Hour,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+		DecayHalfLife:          time.Minute,
+		ScoreThreshold:         0.5,
+	})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	// The score is 2 after the duplicate.
+	logger.Info("foo")
+	logger.Info("foo")
+	assert.Equal(t, 1, ch.counts["foo"])
+
+	// The score decays to 1, and then is 2 again.
+	clock.Advance(time.Minute)
+	logger.Info("foo")
+	assert.Equal(t, 1, ch.counts["foo"])
+
+	// The score decays to 0.5 after a quiet period.
+	clock.Advance(time.Minute * 2)
+	logger.Info("foo")
+	assert.Equal(t, 2, ch.counts["foo"])
+	logger.Info("foo")
+	assert.Equal(t, 2, ch.counts["foo"])
+
+	// A frequent message keeps being suppressed.
+	for i := 0; i < 20; i++ {
+		logger.Info("bar")
+		clock.Advance(time.Second * 30)
+	}
+	assert.Equal(t, 1, ch.counts["bar"])
+
+	// The preloaded keys are subject only to the retention.
+	h.Preload("baz")
+	clock.Advance(time.Minute * 10)
+	logger.Info("baz")
+	assert.Equal(t, 0, ch.counts["baz"])
+}
+
+func TestDecayHalfLifeDefaultThreshold(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod: time.Hour,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+		DecayHalfLife:          time.Minute,
+	})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	logger.Info("foo")
+	clock.Advance(time.Minute - time.Second)
+	logger.Info("foo")
+	assert.Equal(t, 1, ch.counts["foo"])
+
+	// The score is 2 * 0.5^2 = 0.5 two half-lives after the duplicate.
+	clock.Advance(time.Minute * 2)
+	logger.Info("foo")
+	assert.Equal(t, 2, ch.counts["foo"])
+}
@@ -0,0 +1,42 @@
+package deduplog
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Decision is the result of Handle for a record.
+type Decision struct {
+	Key     string
+	Emitted bool
+	Reason  Reason
+	Time    time.Time
+}
+
+// DecisionRecorder records the decisions of the handlers in order.
+// The zero value is ready to use. It is safe for concurrent use.
+type DecisionRecorder struct {
+	mu        sync.Mutex
+	decisions []Decision
+}
+
+func (dr *DecisionRecorder) record(d Decision) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.decisions = append(dr.decisions, d)
+}
+
+// Decisions returns the recorded decisions in order.
+func (dr *DecisionRecorder) Decisions() []Decision {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	return slices.Clone(dr.decisions)
+}
+
+// Reset removes the recorded decisions.
+func (dr *DecisionRecorder) Reset() {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.decisions = nil
+}
@@ -0,0 +1,45 @@
+package deduplog
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecisionRecorder(t *testing.T) {
+	dr := &DecisionRecorder{}
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			DedupLogLevel:          slog.LevelWarn,
+			DecisionRecorder:       dr,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	logger.Info("foo")
+	logger.Info("foo")
+	logger.Error("bar")
+	logger.Error("bar")
+	logger.Info("foo")
+	err := h.Handle(context.Background(), slog.NewRecord(now, slog.LevelDebug, "baz", 0))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Decision{
+		{Key: "foo", Emitted: true, Reason: ReasonEmitted, Time: now},
+		{Key: "foo", Emitted: false, Reason: ReasonSuppressedDuplicate, Time: now},
+		{Key: "bar", Emitted: true, Reason: ReasonBypassed, Time: now},
+		{Key: "bar", Emitted: true, Reason: ReasonBypassed, Time: now},
+		{Key: "foo", Emitted: false, Reason: ReasonSuppressedDuplicate, Time: now},
+		{Key: "baz", Emitted: false, Reason: ReasonDisabled, Time: now},
+	}, dr.Decisions())
+
+	dr.Reset()
+	assert.Empty(t, dr.Decisions())
+}
@@ -2,133 +2,2051 @@ package deduplog
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"log/slog"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 )
 
 const (
 	DefaultHistoryRetentionPeriod time.Duration = time.Second * 20
 	DefaultMaxHistoryCount        int           = 1024
+	DefaultCleanupInterval        time.Duration = time.Second * 2
+	DefaultMaxSummaryValues       int           = 10
+	DefaultExpectedCardinality    int           = 1 << 20
+	DefaultFalsePositiveRate      float64       = 0.01
+	DefaultHitRatioWindow         time.Duration = time.Minute
+	DefaultSimilarityCandidates   int           = 16
+	DefaultAsyncQueueSize         int           = 1024
+	DefaultScoreThreshold         float64       = 0.5
+	DefaultMaxPendingEmits        int           = 1024
 )
 
 type HandlerOptions struct {
 	HistoryRetentionPeriod time.Duration
 	MaxHistoryCount        int
 	DedupLogLevel          slog.Level
+	// CleanupInterval is the interval of removing expired history
+	// in the background. If zero, DefaultCleanupInterval is used.
+	CleanupInterval time.Duration
+	// OverflowHandler receives the records suppressed as duplicates.
+	// If nil, suppressed records are dropped.
+	OverflowHandler slog.Handler
+	// IgnoreOverflowErrors discards the errors returned by OverflowHandler.
+	// Otherwise, they are returned from Handle.
+	IgnoreOverflowErrors bool
+	// AddSequence attaches a "dedup_seq" attribute to the emitted records.
+	// It counts the emissions of each message, and restarts from 1
+	// once the message is removed from the history.
+	AddSequence bool
+	// AddWindowID attaches a "dedup_window" attribute to the emitted records.
+	// It identifies the deduplication window of each message, and is
+	// incremented when the message is emitted after its history expired.
+	AddWindowID bool
+	// CalendarBucket additionally keys messages with the current calendar
+	// hour or day in Location, so that a message is emitted again once
+	// the local hour or day changes. HistoryRetentionPeriod should be long
+	// enough to cover a bucket for the message to be emitted only once in it.
+	CalendarBucket CalendarBucket
+	// Location is the time zone used by CalendarBucket.
+	// If nil, time.Local is used.
+	Location *time.Location
+	// Unsynchronized disables the locking inside the handler.
+	// WARNING: the handler and all handlers derived from it by WithAttrs or
+	// WithGroup are then NOT safe for concurrent use. Use this only if
+	// logging is done from a single goroutine. The background cleanup is
+	// not started, and expired history is removed from Handle instead.
+	Unsynchronized bool
+	// EmitFirstAfterReset makes the keys inserted by Preload after a Reset
+	// not suppress their first real record. The keys preloaded before any
+	// Reset, and the keys logged for real, suppress duplicates as usual.
+	EmitFirstAfterReset bool
+	// ScopeAttr is the key of the attribute scoping the deduplication,
+	// such as "trace_id". The same message is deduplicated separately for
+	// each value of the attribute. Records without it are deduplicated
+	// in the global scope.
+	ScopeAttr string
+	// MaxKeyLength limits the length of the keys stored in the history.
+	// A longer key is truncated, and the hash of the truncated tail is
+	// appended to distinguish it. Zero means no limit.
+	MaxKeyLength int
+	// EvictionPolicy decides which key is removed from the full history.
+	EvictionPolicy EvictionPolicy
+	// EmitSummary emits a summary record for each message whose records
+	// were suppressed, when the message is emitted again or removed from
+	// the history. The summary has the level of the last emitted record,
+	// and the message built by SummaryFormatter.
+	EmitSummary bool
+	// SummaryFormatter builds the message of the summary from the original
+	// message, the number of the suppressed records, and the times when the
+	// first and the last of them were suppressed. It is called without the
+	// lock held, so it may log. If nil, DefaultSummaryFormatter is used.
+	SummaryFormatter func(msg string, count int, firstSeen, lastSeen time.Time) string
+	// HitRatioWindow is the length of the sliding window for Stats.HitRatio.
+	// If zero, DefaultHitRatioWindow is used.
+	HitRatioWindow time.Duration
+	// ProtectHottestOnEvict keeps the key with the most suppressed records
+	// in the history when another key has to be evicted.
+	ProtectHottestOnEvict bool
+	// DedupSyntheticRecords makes the records generated by the handler,
+	// such as summaries, subject to the deduplication. By default, they
+	// bypass it. The synthetic records never generate summaries themselves.
+	DedupSyntheticRecords bool
+	// DedupPredicate decides whether a record at or below DedupLogLevel is
+	// subject to the deduplication. The records for which it returns false
+	// are always emitted. If nil, all the records are subject to it.
+	DedupPredicate func(ctx context.Context, r slog.Record) bool
+	// SpikeThreshold and SpikeWindow detect a spike of a message. If
+	// SpikeThreshold duplicates of a message arrive within SpikeWindow,
+	// the suppression of the message is disabled for SpikeCooldown, so
+	// that the storm is visible in real time. Zero SpikeThreshold disables
+	// the detection. If SpikeCooldown is zero, SpikeWindow is used.
+	SpikeThreshold int
+	SpikeWindow    time.Duration
+	SpikeCooldown  time.Duration
+	// CountStreamHandler receives a record with CountStreamMessage for
+	// each message with new suppressed records every CleanupInterval.
+	// The record has the key of the message and the number of the records
+	// suppressed since the previous one.
+	CountStreamHandler slog.Handler
+	// ConsecutiveOnly suppresses a record only if it has the same message as
+	// the last emitted record, regardless of the time, like uniq(1). When a
+	// different message breaks the run, a record "<msg> (repeated N times)"
+	// is emitted first if N records were suppressed, or the one built by
+	// SummaryFormatter and CountInMessage if they are set. FlushOnShutdown
+	// also emits it for the last run. The history and most of the other
+	// options are not used in this mode.
+	ConsecutiveOnly bool
+	// Normalizer transforms the message before it is used as the key, so
+	// that the messages differing only in the masked parts are deduplicated.
+	// The emitted message is not changed.
+	Normalizer Normalizer
+	// Name identifies the handler among multiple ones. If not empty, it is
+	// included in Stats and attached to the records generated by the
+	// handler as a "dedup_handler" attribute.
+	Name string
+	// SummarizeAttr is the key of the attribute whose distinct values among
+	// the suppressed records are listed in the summary.
+	SummarizeAttr string
+	// MaxSummaryValues is the maximum number of the distinct values listed
+	// for SummarizeAttr. If zero, DefaultMaxSummaryValues is used.
+	MaxSummaryValues int
+	// EmitTimeout bounds the time Handle waits for the wrapped handler.
+	// On timeout, Handle returns ErrEmitTimeout while the wrapped handler
+	// keeps running in the background, so that the records may be emitted
+	// out of order. Zero means no timeout.
+	EmitTimeout time.Duration
+	// MaxPendingEmits is the maximum number of the calls of the wrapped
+	// handler which have not returned, with EmitTimeout. While it is
+	// reached, Handle returns ErrEmitTimeout without calling the wrapped
+	// handler, so that a blocked handler does not pile up goroutines.
+	// If zero, DefaultMaxPendingEmits is used.
+	MaxPendingEmits int
+	// ApproximateMode tracks the messages with a rotating pair of Bloom
+	// filters instead of the exact history, to bound the memory for a huge
+	// number of distinct messages. A message is remembered for one to two
+	// HistoryRetentionPeriods, and a record may be suppressed by mistake
+	// at FalsePositiveRate. MaxHistoryCount, EvictionPolicy, AddSequence,
+	// EmitSummary and the per-key statistics are not effective in this mode.
+	ApproximateMode bool
+	// ExpectedCardinality is the expected number of distinct messages in
+	// a HistoryRetentionPeriod. If zero, DefaultExpectedCardinality is used.
+	ExpectedCardinality int
+	// FalsePositiveRate is the target false positive rate of the Bloom
+	// filters. If zero, DefaultFalsePositiveRate is used.
+	FalsePositiveRate float64
+	// KeyBySource additionally keys messages with the source file and line
+	// of the log call, so that the same message from different call sites
+	// is deduplicated separately. The records without the PC are keyed by
+	// the message only.
+	KeyBySource bool
+	// EmitOnLevelEscalation emits a record even if it is a duplicate,
+	// when its level is higher than the level of the last emitted record
+	// of the same message.
+	EmitOnLevelEscalation bool
+	// DowngradeInsteadOfDrop, if not nil, makes the duplicate records
+	// emitted at this level instead of being suppressed. They are dropped
+	// if the wrapped handler is not enabled for the level.
+	DowngradeInsteadOfDrop *slog.Level
+	// AuditHandler receives a record with AuditMessage for every suppressed
+	// record. It has the original message, the key and the time of the
+	// suppression. The errors are counted in Stats.AuditErrors.
+	AuditHandler slog.Handler
+	// MaxKeyLifetime, if positive, is the maximum time a key stays in the
+	// history since it was first seen, even if it keeps being logged. After
+	// that, the key is removed and the next record of it is emitted.
+	MaxKeyLifetime time.Duration
+	// SimilarityThreshold, if positive, makes a record a duplicate of a
+	// recently emitted message if their similarity based on the edit
+	// distance is at least this value, in (0, 1]. It is experimental.
+	SimilarityThreshold float64
+	// SimilarityCandidates is the number of the recently emitted messages
+	// compared with a record for SimilarityThreshold. If zero,
+	// DefaultSimilarityCandidates is used.
+	SimilarityCandidates int
+	// StripLeadingToken and StripTrailingToken remove the first and the
+	// last whitespace-delimited tokens of the message before it is used as
+	// the key, such as the counter of "task done #1234". The message with
+	// a single token is kept. The emitted message is not changed.
+	StripLeadingToken  bool
+	StripTrailingToken bool
+	// CacheEnabledDecisions caches the results of Enabled of the wrapped
+	// handler per level for a short time, for the handlers with expensive
+	// Enabled. The changes of their levels, such as by slog.LevelVar, take
+	// effect after the cache expires, or immediately if the wrapped handler
+	// implements slog.Leveler. It must not be used if Enabled of the
+	// wrapped handler depends on the context.
+	CacheEnabledDecisions bool
+	// NewCache creates the Cache storing the history, which is shared with
+	// the handlers derived by WithAttrs or WithGroup. If nil, a built-in
+	// map is used. See Cache for the requirements.
+	NewCache func() Cache
+	// LogLifecycle emits a record with LifecycleStartedMessage when the
+	// handler is created by NewDedupHandler, and one with
+	// LifecycleStoppedMessage when it is closed. They have the main options
+	// in effect in the "options" group.
+	LogLifecycle bool
+	// StripPlaceholders removes the format verbs such as "%v", including
+	// the ones rendered by fmt for the wrong arguments like
+	// "%!d(string=foo)", and the placeholders in braces such as "{user}"
+	// from the message before it is used as the key. It is applied after
+	// Normalizer. The emitted message is not changed.
+	StripPlaceholders bool
+	// CountInMessage appends " (xN)" to the message of the summaries
+	// instead of adding the SuppressedCountKey attribute, where N is the
+	// number of the suppressed records. Unless SummaryFormatter is set,
+	// the rest of the message is the original one.
+	CountInMessage bool
+	// HighWaterMark, if positive, is the ratio to MaxHistoryCount in (0, 1]
+	// above which the expired history is removed inline when a key is
+	// inserted, instead of waiting for the background cleanup. The inline
+	// removal runs at most once per a tenth of CleanupInterval.
+	HighWaterMark float64
+	// KeySalt, if not empty, replaces the keys with their HMAC-SHA256
+	// hashes using it as the secret, so that the APIs exposing the keys,
+	// such as DumpHistory and TopSuppressed, do not leak the messages.
+	// SimilarityThreshold does not work with the hashed keys.
+	KeySalt []byte
+	// EventAttr is the key of the attribute identifying the event of a
+	// record, such as "event". If a record has it, its value followed by
+	// the values of EventKeyAttrs is used as the key instead of the
+	// message, so that the records of the same event with different
+	// messages are deduplicated. Normalizer, StripPlaceholders and the
+	// token stripping are not applied to it. Only the attributes of the
+	// record are looked up, not the ones added by WithAttrs.
+	EventAttr string
+	// EventKeyAttrs are the keys of the attributes combined with EventAttr.
+	// The missing ones are keyed as empty.
+	EventKeyAttrs []string
+	// DimensionAttrs are the keys of the attributes whose values are
+	// combined with the message into the key, such as "region" and
+	// "shard". The same message is deduplicated separately for each
+	// combination of the values. The missing ones are keyed as empty.
+	// Unlike EventKeyAttrs, the attributes added by WithAttrs are also
+	// looked up.
+	DimensionAttrs []string
+	// DecisionRecorder, if not nil, records the decision for every record
+	// passed to Handle. It is intended for tests.
+	DecisionRecorder *DecisionRecorder
+	// AsyncEmit passes the records to the wrapped handler in a background
+	// goroutine through a queue, so that Handle returns right after the
+	// deduplication, which is still done synchronously. The errors of the
+	// wrapped handler are counted in Stats.AsyncErrors instead of being
+	// returned, and EmitTimeout is not used. It cannot be used with
+	// Unsynchronized because the background goroutine updates Stats.
+	AsyncEmit bool
+	// AsyncQueueSize is the capacity of the queue for AsyncEmit.
+	// If zero, DefaultAsyncQueueSize is used.
+	AsyncQueueSize int
+	// AsyncFullPolicy decides what to do when the queue for AsyncEmit
+	// is full.
+	AsyncFullPolicy AsyncFullPolicy
+	// KeyByMessageAndAttrs additionally keys records with their attributes,
+	// not including the ones added by WithAttrs. The attributes are keyed
+	// regardless of their order, and their values are normalized so that
+	// the logically equal ones, such as int 1 and string "1", are equal.
+	KeyByMessageAndAttrs bool
+	// OnExpire is called with each key removed from the history by the
+	// cleanup because it expired, and the number of the records suppressed
+	// for it, including the cleanup in Handle by HighWaterMark and
+	// EvictionPolicyRejectNew. It is called without the lock held, so it
+	// may log. It is not called for the keys evicted by MaxHistoryCount.
+	OnExpire func(key string, suppressedCount int)
+	// FlushOnShutdown emits the pending summaries and counts of all the
+	// keys when the context given to NewDedupHandler is done or Close is
+	// called, so that they are not lost. With Unsynchronized, only Close
+	// does it.
+	FlushOnShutdown bool
+	// StripANSI removes the ANSI escape sequences, such as the color codes,
+	// from the message before it is used as the key. It is applied before
+	// Normalizer. The emitted message is not changed.
+	StripANSI bool
+	// SampleEvery, if positive, emits every SampleEvery-th duplicate of
+	// a key as a sample instead of suppressing it. The sample keeps its
+	// own attributes, and has SampledOfKey with the number of the
+	// duplicates it represents, including itself.
+	SampleEvery int
+	// AutoTuneRetention is an experimental mode setting the retention of
+	// each key by its arrival rate, so that the chattier keys are suppressed
+	// longer. A key arriving once per HistoryRetentionPeriod is retained for
+	// HistoryRetentionPeriod, and one arriving N times as often is retained
+	// N times as long, within MinRetention and MaxRetention.
+	AutoTuneRetention bool
+	// MinRetention and MaxRetention bound the retention with
+	// AutoTuneRetention. If zero, HistoryRetentionPeriod/10 and
+	// HistoryRetentionPeriod*10 are used respectively.
+	MinRetention time.Duration
+	MaxRetention time.Duration
+	// EmitOnAttrChange emits a record even if it is a duplicate, when its
+	// attributes differ from the ones of the last emitted record of the same
+	// key. The attributes are compared in the same canonical form as
+	// KeyByMessageAndAttrs.
+	EmitOnAttrChange bool
+	// MaskDigits replaces every run of ASCII digits in the message with
+	// a single byte before it is used as the key, so that "retry 12" and
+	// "retry 3" are deduplicated. It is a faster alternative to
+	// NormalizeNumbers and is applied after the other transformations.
+	// The emitted message is not changed.
+	MaskDigits bool
+	// GlobalMaxEmitRate is the maximum number of records emitted per second
+	// regardless of the key, to protect the wrapped handler from the total
+	// volume. Up to GlobalMaxEmitRate records are emitted in a burst.
+	// The records exceeding it are suppressed after the deduplication check
+	// and counted in Stats.Throttled, except the samples of SampleEvery,
+	// which are counted as duplicates. The records generated by the handler,
+	// such as the summaries, are not limited. The handlers derived by
+	// WithAttrs or WithGroup share the limit. Zero means no limit.
+	GlobalMaxEmitRate float64
+	// FirstEmitCooldown shortens the suppression after the first emission
+	// of a key not in the history. The duplicates are suppressed only for
+	// FirstEmitCooldown, and the next one after that is emitted and starts
+	// the full HistoryRetentionPeriod. It collapses the tight retry bursts
+	// of the one-off messages without hiding them for the full retention.
+	// It has no effect if it is not shorter than HistoryRetentionPeriod.
+	FirstEmitCooldown time.Duration
+	// DebugSuppressed makes the suppressed records emitted unchanged but at
+	// slog.LevelDebug with SuppressedKey, so that enabling the debug level
+	// of the wrapped handler reveals everything the deduplication hides.
+	DebugSuppressed bool
+	// Metrics, if not nil, receives the counters of the handler.
+	Metrics Metrics
+	// MetricsTopK, if positive, reports the numbers of the suppressed
+	// records of the top MetricsTopK keys to Metrics implementing
+	// KeyMetrics, aggregating the rest into MetricsOtherKey to bound the
+	// cardinality.
+	MetricsTopK int
+	// TenantAttr is the key of the attribute identifying the tenant of the
+	// record in a multi-tenant application. Like ScopeAttr, the same
+	// message is deduplicated separately for each tenant. It can be set
+	// by WithAttrs. The records without it belong to no tenant.
+	TenantAttr string
+	// MaxHistoryCountPerTenant, if positive, is the maximum number of the
+	// keys of a tenant in the history, so that a noisy tenant does not
+	// evict the keys of the others. The oldest key of the tenant is evicted
+	// to insert a new one. MaxHistoryCount still limits the total.
+	MaxHistoryCountPerTenant int
+	// DoneContextPolicy decides what NewDedupHandler does if its context
+	// is already done.
+	DoneContextPolicy DoneContextPolicy
+	// SummarizeLevels lists the distinct levels of the suppressed records
+	// in the summary as the SummaryLevelsKey attribute, in ascending order.
+	SummarizeLevels bool
+	// AlwaysEmitAtOrAbove, if not nil, makes the records at or above this
+	// level always emitted as a safety rail, taking precedence over all the
+	// other options such as DedupPredicate and GlobalMaxEmitRate. They are
+	// not recorded in the history.
+	AlwaysEmitAtOrAbove *slog.Level
+	// DryRun makes the handler decide and count the suppression as usual,
+	// but emit the records which would be suppressed with WouldSuppressKey
+	// instead, to measure the effect of the options safely. HandleReport
+	// reports the decisions as if DryRun were not set. AuditHandler,
+	// OverflowHandler and the options emitting the suppressed records,
+	// such as DowngradeInsteadOfDrop, are not used.
+	DryRun bool
+	// KeyPrefixLength, if positive, makes only the first KeyPrefixLength
+	// runes of the message used as the key, so that the messages with
+	// a common prefix and a variable tail are deduplicated together.
+	// It is applied after the other transformations of the message.
+	// The emitted message is not changed.
+	KeyPrefixLength int
+	// SummaryExamples, if positive, lists up to SummaryExamples distinct
+	// messages of the suppressed records in the summary as the
+	// SummaryExamplesKey attribute. They show the concrete messages when
+	// options such as Normalizer deduplicate different messages together.
+	SummaryExamples int
+	// AddKeyHashAttr adds the KeyHashKey attribute, the hash of the key in
+	// hex, to the emitted records, so that the external systems can group
+	// them by the same identity as the deduplication.
+	AddKeyHashAttr bool
+	// DedupLogLevelExclusive makes only the records strictly below
+	// DedupLogLevel subject to the deduplication. By default, the records
+	// at DedupLogLevel are also subject to it.
+	DedupLogLevelExclusive bool
+	// CompactionThreshold, if positive, makes the cleanup rebuild the
+	// history map when the number of the keys falls to CompactionThreshold
+	// of its peak since the last rebuild, to release the memory the map
+	// keeps after a spike. It must be less than 1. It has no effect if
+	// NewCache is set.
+	CompactionThreshold float64
+	// HighSuppressionWarnRatio, if positive, emits a warning at
+	// slog.LevelWarn listing the most suppressed keys when the suppressed
+	// records outnumber the emitted ones by more than this ratio in
+	// HitRatioWindow, which may indicate a logging loop. The ratio is
+	// checked when a record is suppressed and on each cleanup, and the
+	// warning is emitted at most once per HitRatioWindow.
+	HighSuppressionWarnRatio float64
+	// DecayHalfLife, if positive, gives each key a score which every record
+	// of it increments by one and which halves every DecayHalfLife.
+	// A duplicate is emitted if the score has decayed to ScoreThreshold,
+	// so that a message quiet for long enough is emitted again before
+	// HistoryRetentionPeriod passes. If ScoreThreshold is zero,
+	// DefaultScoreThreshold is used, with which a message logged once is
+	// suppressed for DecayHalfLife.
+	DecayHalfLife  time.Duration
+	ScoreThreshold float64
+}
+
+var (
+	// ErrEmitTimeout is returned by Handle if the wrapped handler does not
+	// return within EmitTimeout.
+	ErrEmitTimeout = errors.New("emit to the wrapped handler timed out")
+	// ErrHandlerClosed is returned by Handle after Close is called.
+	ErrHandlerClosed = errors.New("handler is closed")
+)
+
+type CalendarBucket int
+
+const (
+	CalendarBucketNone CalendarBucket = iota
+	CalendarBucketHourly
+	CalendarBucketDaily
+)
+
+type EvictionPolicy int
+
+const (
+	// EvictionPolicyOldestFirst evicts the key expiring first.
+	EvictionPolicyOldestFirst EvictionPolicy = iota
+	// EvictionPolicyLowestLevelOldestFirst evicts the key with the lowest
+	// level, and the key expiring first among them.
+	EvictionPolicyLowestLevelOldestFirst
+	// EvictionPolicyRejectNew evicts no key. While the history is full,
+	// the new keys are not stored, so their records are emitted every time,
+	// and the keys already known keep being suppressed. The expired keys
+	// are removed to make room at most once per a tenth of CleanupInterval.
+	EvictionPolicyRejectNew
+)
+
+// initialHistoryCapacity is the maximum capacity hint of the history map
+// to avoid the growth of the map for small MaxHistoryCount.
+const initialHistoryCapacity = 1024
+
+// The attributes added by the handler follow the attributes of the record
+// in a fixed order: SequenceKey, WindowIDKey and KeyHashKey for the emitted
+// records, SampledOfKey and KeyHashKey for the samples, SuppressedKey for
+// the records of DebugSuppressed, WouldSuppressKey for the records of
+// DryRun, and HandlerNameKey, SuppressedCountKey, SummaryValuesKey,
+// SummaryLevelsKey and SummaryExamplesKey for the records generated by the
+// handler.
+const (
+	SequenceKey      = "dedup_seq"
+	WindowIDKey      = "dedup_window"
+	KeyHashKey       = "dedup_key_hash"
+	HandlerNameKey   = "dedup_handler"
+	SampledOfKey     = "sampled_of"
+	SuppressedKey    = "suppressed"
+	WouldSuppressKey = "would_suppress"
+)
+
+// HistoryEntry is the state of a key in the history. Its contents are
+// managed by DedupHandler and opaque to Cache implementations.
+type HistoryEntry struct {
+	expireTime time.Time
+	seq        uint64
+	windowID   uint64
+	suppressed uint64
+	// order is the value of DedupHandler.updateCount when the entry
+	// was last updated. It breaks ties between equal expireTimes.
+	order uint64
+	// firstSeen is the time when the entry was inserted.
+	firstSeen time.Time
+	// lastEmitted is the time when a record of the entry was last emitted.
+	lastEmitted time.Time
+	// lastArrival and avgInterval are the time of the last record of the
+	// entry and the moving average of the intervals between the records.
+	// They are used only if AutoTuneRetention is set.
+	lastArrival time.Time
+	avgInterval time.Duration
+	// tenant is the value of TenantAttr of the entry if hasTenant is true.
+	tenant    string
+	hasTenant bool
+	// cooldownEnd is the end of FirstEmitCooldown. It is zero if the entry
+	// is not in the cooldown.
+	cooldownEnd time.Time
+	// score is the score of DecayHalfLife at scoreTime. scoreTime is zero
+	// if the entry has not been scored.
+	score     float64
+	scoreTime time.Time
+	// attrsHash is the hash of the attributes of the last emitted record.
+	// It is used only if EmitOnAttrChange is set.
+	attrsHash uint64
+	// sampleCount is the number of the duplicates since the last emission
+	// or sample. It is used only if SampleEvery is set.
+	sampleCount uint64
+	// preloaded is true if the entry was inserted by Preload
+	// and has not been logged for real since then.
+	preloaded bool
+	// level is the level of the last record logged for the entry.
+	level slog.Level
+	// msg, pending, values, levels and examples are the message, the number
+	// of records suppressed since the last emission, and the distinct values
+	// of SummarizeAttr, levels and messages in them. firstSuppressed and
+	// lastSuppressed are the times of the first and the last of the records.
+	// They are used only if EmitSummary is set.
+	msg             string
+	pending         uint64
+	values          []string
+	levels          []slog.Level
+	examples        []string
+	firstSuppressed time.Time
+	lastSuppressed  time.Time
+	// synthetic is true if the entry is for the records generated
+	// by the handler.
+	synthetic bool
+	// spikeStart and spikeHits are the start time and the number of the
+	// duplicates of the current spike window. The suppression is disabled
+	// until spikeUntil.
+	spikeStart time.Time
+	spikeHits  int
+	spikeUntil time.Time
+}
+
+// KeyCount is a pair of a deduplication key and the number of
+// records suppressed for it.
+type KeyCount struct {
+	Key   string
+	Count uint64
 }
 
 type DedupHandler struct {
-	ctx          context.Context
-	mu           sync.Mutex
-	handler      slog.Handler
-	opts         HandlerOptions
-	history      map[string]time.Time
-	historyCount int
+	// dedupState is shared among the handlers derived by WithAttrs or
+	// WithGroup, so that they deduplicate the records together.
+	*dedupState
+	// handler caches the wrapped handler, which is the base handler with
+	// derivations applied. It is rebuilt when SetHandler replaces the base.
+	handler atomic.Pointer[wrappedHandler]
+	// derivations are the attributes and the groups given by WithAttrs and
+	// WithGroup, in the order they were given.
+	derivations []derivation
+	// overflowHandler is OverflowHandler with the attributes and the
+	// groups of the handler.
+	overflowHandler slog.Handler
+	scope           string
+	hasScope        bool
+	tenant          string
+	hasTenant       bool
+	// dimensions are the values of DimensionAttrs given by WithAttrs.
+	dimensions map[string]string
+	// enabledCache maps slog.Level to enabledDecision.
+	// It is used only if CacheEnabledDecisions is set.
+	enabledCache sync.Map
 }
 
+// dedupState is the state of a DedupHandler and the handlers derived
+// from it.
+type dedupState struct {
+	// lifetimeCtx controls the lifetime of the background cleanup.
+	// It is never passed to the wrapped handler; Handle uses its own ctx.
+	lifetimeCtx context.Context
+	// base is the handler given to NewDedupHandler or SetHandler.
+	base        atomic.Pointer[slog.Handler]
+	mu          sync.Mutex
+	opts        HandlerOptions
+	history     Cache
+	now         func() time.Time
+	lastCleanup time.Time
+	// inlineCleanup is true if the expired history is removed in Handle
+	// instead of the background goroutine.
+	inlineCleanup bool
+	lastWall      time.Time
+	monotonic     time.Time
+	updateCount   uint64
+	stats         Stats
+	hits          hitWindow
+	resetDone     bool
+	// nextSuppressionWarn is the time after which the warning of
+	// HighSuppressionWarnRatio can be emitted again.
+	nextSuppressionWarn time.Time
+	summaries           []pendingSummary
+	countDeltas         map[string]uint64
+	filters             *rotatingBloomFilter
+	run                 consecutiveRun
+	// recentKeys are the keys recently emitted, oldest first.
+	// They are used only if SimilarityThreshold is set.
+	recentKeys    []string
+	cleanupPaused atomic.Bool
+	// lastSweep and sweepCount are the time and the number of the periodic
+	// removals of the expired history.
+	lastSweep time.Time
+	// lastInlineSweep is the time of the last removal by sweepInline.
+	lastInlineSweep time.Time
+	sweepCount      int64
+	// pendingExpired are the keys removed by sweepInline, for which
+	// OnExpire is called when the lock is released.
+	pendingExpired []KeyCount
+	closed         atomic.Bool
+	// root is the handler created by NewDedupHandler. Close drains the
+	// pending summaries through it, whichever handler it is called on.
+	root *DedupHandler
+	// cancel stops the background cleanup.
+	cancel context.CancelFunc
+	// tenantCounts maps the tenants to the numbers of their keys in the
+	// history. It is used only if MaxHistoryCountPerTenant is set.
+	tenantCounts map[string]int
+	// metrics is Metrics, or a no-op if it is nil.
+	metrics Metrics
+	// throttle is used only if GlobalMaxEmitRate is set.
+	throttle *tokenBucket
+	// cleanupDone is closed when the background cleanup stops.
+	// It is nil if inlineCleanup is true.
+	cleanupDone chan struct{}
+	// queue is used only if AsyncEmit is set.
+	queue chan asyncItem
+	// pendingEmits is the semaphore bounding the calls of the wrapped
+	// handler by MaxPendingEmits. It is used only if EmitTimeout is set.
+	pendingEmits chan struct{}
+	// asyncDone is closed when the emitter of AsyncEmit has emitted the
+	// queued records and stopped. It is nil if AsyncEmit is not set.
+	asyncDone chan struct{}
+}
+
+// NewDedupHandler creates a DedupHandler wrapping handler.
+// Invalid option values are replaced with the defaults.
 func NewDedupHandler(ctx context.Context, handler slog.Handler, opts *HandlerOptions) *DedupHandler {
-	h := &DedupHandler{
-		ctx:     ctx,
-		mu:      sync.Mutex{},
-		handler: handler,
-		history: make(map[string]time.Time),
+	var o HandlerOptions
+	if opts != nil {
+		o = *opts
+	} else {
+		o.DedupLogLevel = slog.LevelInfo
+	}
+	if o.HistoryRetentionPeriod <= 0 {
+		o.HistoryRetentionPeriod = DefaultHistoryRetentionPeriod
+	}
+	if o.MaxHistoryCount <= 0 {
+		o.MaxHistoryCount = DefaultMaxHistoryCount
+	}
+	if o.CleanupInterval <= 0 {
+		o.CleanupInterval = DefaultCleanupInterval
+	}
+	if o.Unsynchronized {
+		o.AsyncEmit = false
+	}
+	if o.MaxKeyLength < 0 {
+		o.MaxKeyLength = 0
+	}
+	if o.MaxSummaryValues <= 0 {
+		o.MaxSummaryValues = DefaultMaxSummaryValues
+	}
+	if o.ExpectedCardinality <= 0 {
+		o.ExpectedCardinality = DefaultExpectedCardinality
+	}
+	if o.FalsePositiveRate <= 0 || o.FalsePositiveRate >= 1 {
+		o.FalsePositiveRate = DefaultFalsePositiveRate
+	}
+	if o.HitRatioWindow <= 0 {
+		o.HitRatioWindow = DefaultHitRatioWindow
+	}
+	if o.SimilarityThreshold < 0 || o.SimilarityThreshold > 1 {
+		o.SimilarityThreshold = 0
+	}
+	if o.SimilarityCandidates <= 0 {
+		o.SimilarityCandidates = DefaultSimilarityCandidates
+	}
+	if o.HighWaterMark < 0 || o.HighWaterMark > 1 {
+		o.HighWaterMark = 0
+	}
+	if o.AsyncQueueSize <= 0 {
+		o.AsyncQueueSize = DefaultAsyncQueueSize
+	}
+	if o.MaxPendingEmits <= 0 {
+		o.MaxPendingEmits = DefaultMaxPendingEmits
+	}
+	if o.ScoreThreshold <= 0 {
+		o.ScoreThreshold = DefaultScoreThreshold
+	}
+	if o.CompactionThreshold < 0 || o.CompactionThreshold >= 1 {
+		o.CompactionThreshold = 0
+	}
+	if o.GlobalMaxEmitRate < 0 {
+		o.GlobalMaxEmitRate = 0
+	}
+	if o.FirstEmitCooldown < 0 {
+		o.FirstEmitCooldown = 0
+	}
+	if o.AutoTuneRetention {
+		if o.MinRetention <= 0 {
+			o.MinRetention = o.HistoryRetentionPeriod / 10
+		}
+		if o.MaxRetention <= 0 {
+			o.MaxRetention = o.HistoryRetentionPeriod * 10
+		}
+		o.MaxRetention = max(o.MaxRetention, o.MinRetention)
+	}
+	if o.SpikeThreshold < 0 || o.SpikeWindow <= 0 {
+		o.SpikeThreshold = 0
+	}
+	if o.SpikeCooldown <= 0 {
+		o.SpikeCooldown = o.SpikeWindow
+	}
+	doneAtStart := ctx.Err() != nil
+	if doneAtStart && o.DoneContextPolicy == DoneContextDetach {
+		ctx = context.WithoutCancel(ctx)
 	}
+	ctx, cancel := context.WithCancel(ctx)
+	h := newDedupHandler(ctx, handler, o, time.Now)
+	h.cancel = cancel
+	if doneAtStart && o.DoneContextPolicy == DoneContextWarn {
+		h.warnDoneContext(ctx)
+	}
+	if o.AsyncEmit {
+		h.startAsyncEmitter()
+	}
+	h.logLifecycle(ctx, LifecycleStartedMessage)
+	return h
+}
 
+// NewDedupHandlerChecked is the same as NewDedupHandler,
+// but returns an error if opts contains invalid values.
+func NewDedupHandlerChecked(ctx context.Context, handler slog.Handler, opts *HandlerOptions) (*DedupHandler, error) {
 	if opts != nil {
-		h.opts = *opts
-	} else {
-		h.opts.HistoryRetentionPeriod = DefaultHistoryRetentionPeriod
-		h.opts.MaxHistoryCount = DefaultMaxHistoryCount
-		h.opts.DedupLogLevel = slog.LevelInfo
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return NewDedupHandler(ctx, handler, opts), nil
+}
+
+func (o *HandlerOptions) validate() error {
+	if o.HistoryRetentionPeriod < 0 {
+		return fmt.Errorf("HistoryRetentionPeriod must not be negative: %v", o.HistoryRetentionPeriod)
+	}
+	if o.MaxHistoryCount <= 0 {
+		return fmt.Errorf("MaxHistoryCount must be positive: %d", o.MaxHistoryCount)
+	}
+	if o.CleanupInterval < 0 {
+		return fmt.Errorf("CleanupInterval must not be negative: %v", o.CleanupInterval)
+	}
+	if o.AsyncEmit && o.Unsynchronized {
+		return fmt.Errorf("AsyncEmit must not be used with Unsynchronized")
+	}
+	if o.MaxKeyLength < 0 {
+		return fmt.Errorf("MaxKeyLength must not be negative: %d", o.MaxKeyLength)
+	}
+	if o.MaxSummaryValues < 0 {
+		return fmt.Errorf("MaxSummaryValues must not be negative: %d", o.MaxSummaryValues)
+	}
+	if o.EmitTimeout < 0 {
+		return fmt.Errorf("EmitTimeout must not be negative: %v", o.EmitTimeout)
+	}
+	if o.ExpectedCardinality < 0 {
+		return fmt.Errorf("ExpectedCardinality must not be negative: %d", o.ExpectedCardinality)
+	}
+	if o.FalsePositiveRate < 0 || o.FalsePositiveRate >= 1 {
+		return fmt.Errorf("FalsePositiveRate must be in [0, 1): %v", o.FalsePositiveRate)
+	}
+	if o.HitRatioWindow < 0 {
+		return fmt.Errorf("HitRatioWindow must not be negative: %v", o.HitRatioWindow)
+	}
+	if o.SpikeThreshold < 0 {
+		return fmt.Errorf("SpikeThreshold must not be negative: %d", o.SpikeThreshold)
+	}
+	if o.SpikeThreshold > 0 && o.SpikeWindow <= 0 {
+		return fmt.Errorf("SpikeWindow must be positive with SpikeThreshold: %v", o.SpikeWindow)
+	}
+	if o.SpikeCooldown < 0 {
+		return fmt.Errorf("SpikeCooldown must not be negative: %v", o.SpikeCooldown)
+	}
+	if o.MaxKeyLifetime < 0 {
+		return fmt.Errorf("MaxKeyLifetime must not be negative: %v", o.MaxKeyLifetime)
+	}
+	if o.SimilarityThreshold < 0 || o.SimilarityThreshold > 1 {
+		return fmt.Errorf("SimilarityThreshold must be in [0, 1]: %v", o.SimilarityThreshold)
+	}
+	if o.SimilarityCandidates < 0 {
+		return fmt.Errorf("SimilarityCandidates must not be negative: %d", o.SimilarityCandidates)
+	}
+	if o.HighWaterMark < 0 || o.HighWaterMark > 1 {
+		return fmt.Errorf("HighWaterMark must be in [0, 1]: %v", o.HighWaterMark)
+	}
+	if o.MaxPendingEmits < 0 {
+		return fmt.Errorf("MaxPendingEmits must not be negative: %d", o.MaxPendingEmits)
+	}
+	if o.AsyncQueueSize < 0 {
+		return fmt.Errorf("AsyncQueueSize must not be negative: %d", o.AsyncQueueSize)
+	}
+	if o.SampleEvery < 0 {
+		return fmt.Errorf("SampleEvery must not be negative: %d", o.SampleEvery)
+	}
+	if o.GlobalMaxEmitRate < 0 {
+		return fmt.Errorf("GlobalMaxEmitRate must not be negative: %v", o.GlobalMaxEmitRate)
+	}
+	if o.FirstEmitCooldown < 0 {
+		return fmt.Errorf("FirstEmitCooldown must not be negative: %v", o.FirstEmitCooldown)
+	}
+	if o.MaxHistoryCountPerTenant < 0 {
+		return fmt.Errorf("MaxHistoryCountPerTenant must not be negative: %d", o.MaxHistoryCountPerTenant)
+	}
+	if o.SummaryExamples < 0 {
+		return fmt.Errorf("SummaryExamples must not be negative: %d", o.SummaryExamples)
+	}
+	if o.DecayHalfLife < 0 {
+		return fmt.Errorf("DecayHalfLife must not be negative: %v", o.DecayHalfLife)
+	}
+	if o.ScoreThreshold < 0 {
+		return fmt.Errorf("ScoreThreshold must not be negative: %v", o.ScoreThreshold)
+	}
+	if o.MetricsTopK < 0 {
+		return fmt.Errorf("MetricsTopK must not be negative: %d", o.MetricsTopK)
+	}
+	if o.HighSuppressionWarnRatio < 0 {
+		return fmt.Errorf("HighSuppressionWarnRatio must not be negative: %v", o.HighSuppressionWarnRatio)
+	}
+	if o.CompactionThreshold < 0 || o.CompactionThreshold >= 1 {
+		return fmt.Errorf("CompactionThreshold must be in [0, 1): %v", o.CompactionThreshold)
+	}
+	if o.KeyPrefixLength < 0 {
+		return fmt.Errorf("KeyPrefixLength must not be negative: %d", o.KeyPrefixLength)
+	}
+	if o.MinRetention < 0 {
+		return fmt.Errorf("MinRetention must not be negative: %v", o.MinRetention)
+	}
+	if o.MaxRetention < 0 {
+		return fmt.Errorf("MaxRetention must not be negative: %v", o.MaxRetention)
+	}
+	if o.MinRetention > 0 && o.MaxRetention > 0 && o.MinRetention > o.MaxRetention {
+		return fmt.Errorf("MinRetention must not be greater than MaxRetention: %v > %v",
+			o.MinRetention, o.MaxRetention)
+	}
+	return nil
+}
+
+// newDedupHandler creates a DedupHandler with a new state, and starts the
+// background cleanup unless Unsynchronized is set.
+func newDedupHandler(ctx context.Context, handler slog.Handler, opts HandlerOptions,
+	now func() time.Time) *DedupHandler {
+	h := &DedupHandler{
+		dedupState: &dedupState{
+			lifetimeCtx:   ctx,
+			opts:          opts,
+			stats:         newStats(),
+			hits:          newHitWindow(opts.HitRatioWindow),
+			now:           now,
+			lastCleanup:   now(),
+			lastWall:      now(),
+			monotonic:     now(),
+			inlineCleanup: opts.Unsynchronized,
+		},
+		overflowHandler: opts.OverflowHandler,
+	}
+
+	h.root = h
+	h.base.Store(&handler)
+	h.metrics = opts.Metrics
+	if h.metrics == nil {
+		h.metrics = noopMetrics{}
+	}
+	if opts.CountStreamHandler != nil {
+		h.countDeltas = make(map[string]uint64)
+	}
+	if opts.TenantAttr != "" && opts.MaxHistoryCountPerTenant > 0 {
+		h.tenantCounts = make(map[string]int)
+	}
+	if opts.GlobalMaxEmitRate > 0 {
+		h.throttle = newTokenBucket(opts.GlobalMaxEmitRate, now())
+	}
+	if opts.EmitTimeout > 0 {
+		h.pendingEmits = make(chan struct{}, opts.MaxPendingEmits)
+	}
+	h.history = h.newCache(min(opts.MaxHistoryCount, initialHistoryCapacity))
+	if h.opts.ApproximateMode {
+		h.filters = newRotatingBloomFilter(h.opts.ExpectedCardinality, h.opts.FalsePositiveRate, now())
 	}
 
-	ticker := time.NewTicker(time.Second * 2)
+	if h.inlineCleanup {
+		return h
+	}
+
+	ticker := time.NewTicker(h.opts.CleanupInterval)
+	h.cleanupDone = make(chan struct{})
 	go func() {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			h.removeExpiredHistory()
+		defer close(h.cleanupDone)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.lifetimeCtx.Done():
+				if h.opts.FlushOnShutdown {
+					h.drain(context.WithoutCancel(h.lifetimeCtx))
+				}
+				return
+			case <-ticker.C:
+				_ = h.flushCounts(h.lifetimeCtx)
+				if h.cleanupPaused.Load() {
+					continue
+				}
+				h.removeExpiredHistory()
+				_ = h.flushSummaries(h.lifetimeCtx)
+				_ = h.warnHighSuppression(h.lifetimeCtx)
+			}
 		}
-
 	}()
 
 	return h
 }
 
+// Close stops the background cleanup and AsyncEmit. After that, Handle returns
+// ErrHandlerClosed without handling the record. It returns after the summaries
+// of FlushOnShutdown and the records queued for AsyncEmit are emitted, so the
+// process can exit right after it. The handlers derived by WithAttrs or
+// WithGroup share the state, so closing any of them closes all. It always
+// returns nil.
+func (h *DedupHandler) Close() error {
+	first := !h.closed.Swap(true)
+	if first && h.opts.FlushOnShutdown && h.inlineCleanup {
+		h.root.drain(h.lifetimeCtx)
+	}
+	if h.cancel != nil {
+		h.cancel()
+	}
+	if h.cleanupDone != nil {
+		<-h.cleanupDone
+	}
+	if h.asyncDone != nil {
+		<-h.asyncDone
+	}
+	// The stopped record follows everything emitted by the handler.
+	if first {
+		h.root.logLifecycle(context.WithoutCancel(h.lifetimeCtx), LifecycleStoppedMessage)
+	}
+	return nil
+}
+
+// Config returns the options in effect, with the defaults applied.
+func (h *DedupHandler) Config() HandlerOptions {
+	h.lock()
+	defer h.unlock()
+	return h.opts
+}
+
+// monotonicNow returns the current time which never goes backward even if
+// the wall clock does. time.Now is already safe due to its monotonic clock
+// reading, but this protects the history from the clocks without it.
+// The backward steps of the clock are ignored, so that the expiration
+// times computed before them do not linger. It must be called with the
+// lock held.
+func (h *DedupHandler) monotonicNow() time.Time {
+	now := h.now()
+	if d := now.Sub(h.lastWall); d > 0 {
+		h.monotonic = h.monotonic.Add(d)
+	}
+	h.lastWall = now
+	return h.monotonic
+}
+
 func (h *DedupHandler) expired(expireTime time.Time) bool {
-	return time.Now().After(expireTime)
+	return h.monotonicNow().After(expireTime)
+}
+
+// outlived reports whether e has been in the history for MaxKeyLifetime.
+func (h *DedupHandler) outlived(e *HistoryEntry) bool {
+	return h.opts.MaxKeyLifetime > 0 &&
+		!h.monotonicNow().Before(e.firstSeen.Add(h.opts.MaxKeyLifetime))
+}
+
+// LastSweepTime returns the time when the expired history was last removed
+// by the periodic cleanup, or zero if it has never been. It tells whether
+// the cleanup is running, along with SweepCount.
+func (h *DedupHandler) LastSweepTime() time.Time {
+	h.lock()
+	defer h.unlock()
+	return h.lastSweep
+}
+
+// SweepCount returns the number of the periodic removals of the expired
+// history. The cleanup paused by PauseCleanup is not counted.
+func (h *DedupHandler) SweepCount() int64 {
+	h.lock()
+	defer h.unlock()
+	return h.sweepCount
+}
+
+// PauseCleanup stops removing the expired history in the background
+// until ResumeCleanup is called. The expired history is still ignored
+// by the deduplication. It is safe to call it multiple times.
+func (h *DedupHandler) PauseCleanup() {
+	h.cleanupPaused.Store(true)
+}
+
+// ResumeCleanup resumes the background cleanup paused by PauseCleanup.
+func (h *DedupHandler) ResumeCleanup() {
+	h.cleanupPaused.Store(false)
+}
+
+func (h *DedupHandler) lock() {
+	if !h.opts.Unsynchronized {
+		h.mu.Lock()
+	}
+}
+
+func (h *DedupHandler) unlock() {
+	expired := h.pendingExpired
+	h.pendingExpired = nil
+	if !h.opts.Unsynchronized {
+		h.mu.Unlock()
+	}
+	for _, kc := range expired {
+		h.opts.OnExpire(kc.Key, int(kc.Count))
+	}
+}
+
+// cleanupDue reports whether CleanupInterval has passed since the last
+// inline cleanup, and if so, restarts the interval.
+func (h *DedupHandler) cleanupDue() bool {
+	h.lock()
+	defer h.unlock()
+	now := h.now()
+	if now.Sub(h.lastCleanup) < h.opts.CleanupInterval {
+		return false
+	}
+	h.lastCleanup = now
+	return true
 }
 
 func (h *DedupHandler) removeExpiredHistory() {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	h.lock()
+	removed := h.removeExpiredHistoryLocked()
+	h.compactHistory()
+	h.lastSweep = h.now()
+	h.sweepCount += 1
+	h.unlock()
+	h.reportKeyMetrics()
+	if h.opts.OnExpire == nil {
+		return
+	}
+	for _, kc := range removed {
+		h.opts.OnExpire(kc.Key, int(kc.Count))
+	}
+}
 
-	for k, v := range h.history {
-		if h.expired(v) {
-			delete(h.history, k)
-			h.historyCount -= 1
+// removeExpiredHistoryLocked is the same as removeExpiredHistory, but
+// returns the removed keys with their suppressed counts instead of calling
+// OnExpire. It must be called with the lock held.
+func (h *DedupHandler) removeExpiredHistoryLocked() []KeyCount {
+	type keyEntry struct {
+		key   string
+		entry *HistoryEntry
+	}
+	var expired []keyEntry
+	h.history.Range(func(k string, v *HistoryEntry) bool {
+		if h.expired(v.expireTime) || h.outlived(v) {
+			expired = append(expired, keyEntry{key: k, entry: v})
 		}
+		return true
+	})
+	removed := make([]KeyCount, 0, len(expired))
+	for _, ke := range expired {
+		h.deleteHistory(ke.key, ke.entry)
+		removed = append(removed, KeyCount{Key: ke.key, Count: ke.entry.suppressed})
+	}
+	return removed
+}
+
+// compactHistory rebuilds the built-in history map if it has shrunk below
+// CompactionThreshold of its peak. It must be called with the lock held.
+func (h *DedupHandler) compactHistory() {
+	if h.opts.CompactionThreshold <= 0 {
+		return
+	}
+	m, ok := h.history.(mapCache)
+	if !ok || len(m) == h.stats.HistoryPeak ||
+		float64(len(m)) > h.opts.CompactionThreshold*float64(h.stats.HistoryPeak) {
+		return
+	}
+	compacted := make(mapCache, len(m))
+	for k, v := range m {
+		compacted[k] = v
 	}
+	h.history = compacted
+	h.stats.HistoryPeak = len(compacted)
+	h.stats.Compactions += 1
+}
+
+// deleteHistory removes the entry e for key from the history.
+// The summary of e is queued if needed.
+func (h *DedupHandler) deleteHistory(key string, e *HistoryEntry) {
+	h.queueSummary(e)
+	h.countTenant(e, -1)
+	h.history.Delete(key)
+	h.metrics.SetHistorySize(h.history.Len())
 }
 
 func (h *DedupHandler) Enabled(ctx context.Context, level slog.Level) bool {
-	return h.handler.Enabled(ctx, level)
+	return h.wrappedEnabled(ctx, level)
 }
 
-func (h *DedupHandler) duplicated(msg string) bool {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	if _, ok := h.history[msg]; !ok {
-		return false
+// duplicated reports whether key is in the unexpired history.
+// If so, the suppression counts are incremented. If the duplicate is
+// sampled for SampleEvery, it returns false and the number of the
+// duplicates the sample represents.
+func (h *DedupHandler) duplicated(key string, r slog.Record) (bool, uint64) {
+	h.lock()
+	defer h.unlock()
+	e, dup := h.lookupDuplicate(key, r)
+	if !dup && h.opts.SimilarityThreshold > 0 {
+		key, e, dup = h.lookupSimilar(key, r)
+	}
+	if dup && h.opts.SpikeThreshold > 0 && h.spiking(e) {
+		dup = false
+	}
+	h.hits.record(h.now(), dup)
+	if !dup {
+		return false, 0
+	}
+	if h.opts.AutoTuneRetention {
+		h.observeArrival(e)
 	}
-	if h.expired(h.history[msg]) {
+	if h.opts.DecayHalfLife > 0 {
+		h.addScore(e)
+	}
+	if h.opts.SampleEvery > 0 {
+		e.sampleCount += 1
+		if e.sampleCount >= uint64(h.opts.SampleEvery) && h.allowEmit() {
+			n := e.sampleCount
+			e.sampleCount = 0
+			h.stats.Emitted += 1
+			h.metrics.IncEmitted()
+			return false, n
+		}
+	}
+	e.suppressed += 1
+	if h.opts.CountStreamHandler != nil {
+		h.countDeltas[key] += 1
+	}
+	h.stats.Suppressed += 1
+	h.metrics.IncSuppressed()
+	h.stats.SuppressedByLevel[r.Level] += 1
+	if h.opts.EmitSummary {
+		h.recordSuppressed(e, r)
+	}
+	return true, 0
+}
+
+// spiking counts a duplicate of e, and reports whether the message
+// is in a spike.
+func (h *DedupHandler) spiking(e *HistoryEntry) bool {
+	now := h.monotonicNow()
+	if now.Before(e.spikeUntil) {
+		return true
+	}
+	if now.Sub(e.spikeStart) >= h.opts.SpikeWindow {
+		e.spikeStart = now
+		e.spikeHits = 0
+	}
+	e.spikeHits += 1
+	if e.spikeHits < h.opts.SpikeThreshold {
 		return false
 	}
+	e.spikeUntil = now.Add(h.opts.SpikeCooldown)
+	e.spikeHits = 0
 	return true
 }
 
-func (h *DedupHandler) removeOldestHistory() {
+func (h *DedupHandler) lookupDuplicate(key string, r slog.Record) (*HistoryEntry, bool) {
+	e, ok := h.history.Get(key)
+	if !ok || h.expired(e.expireTime) || h.outlived(e) {
+		return nil, false
+	}
+	if h.opts.EmitFirstAfterReset && h.resetDone && e.preloaded {
+		return nil, false
+	}
+	if h.opts.EmitOnLevelEscalation && r.Level > e.level {
+		return nil, false
+	}
+	if h.opts.EmitOnAttrChange && attrsHash(r) != e.attrsHash {
+		return nil, false
+	}
+	if !e.cooldownEnd.IsZero() && h.expired(e.cooldownEnd) {
+		return nil, false
+	}
+	if h.scoreDecayed(e) {
+		return nil, false
+	}
+	return e, true
+}
+
+// LastEmitted returns the time when a record of key was last emitted.
+// It returns false if key is not in the history or has not been emitted,
+// e.g. inserted by Preload.
+func (h *DedupHandler) LastEmitted(key string) (time.Time, bool) {
+	h.lock()
+	defer h.unlock()
+	e, ok := h.history.Get(key)
+	if !ok || e.lastEmitted.IsZero() {
+		return time.Time{}, false
+	}
+	return e.lastEmitted, true
+}
+
+// DumpHistory returns all the keys in the history with the numbers of
+// the records suppressed for them, sorted by the key. Like ExportState,
+// it does not block the logging while the history is copied.
+func (h *DedupHandler) DumpHistory() []KeyCount {
+	var kcs []KeyCount
+	h.rangeSnapshot(func(k string, v *HistoryEntry) bool {
+		kcs = append(kcs, KeyCount{Key: k, Count: v.suppressed})
+		return true
+	})
+	sort.Slice(kcs, func(i, j int) bool {
+		return kcs[i].Key < kcs[j].Key
+	})
+	return kcs
+}
+
+// TopSuppressed returns at most n keys in the history in descending order
+// of the number of suppressed records. Keys without suppression are omitted.
+func (h *DedupHandler) TopSuppressed(n int) []KeyCount {
+	if n <= 0 {
+		return nil
+	}
+	kcs := h.suppressedKeyCounts()
+	if len(kcs) > n {
+		kcs = kcs[:n]
+	}
+	return kcs
+}
+
+// suppressedKeyCounts returns the keys in the history with suppression
+// in descending order of the number of suppressed records.
+func (h *DedupHandler) suppressedKeyCounts() []KeyCount {
+	h.lock()
+	kcs := make([]KeyCount, 0, h.history.Len())
+	h.history.Range(func(k string, v *HistoryEntry) bool {
+		if v.suppressed > 0 {
+			kcs = append(kcs, KeyCount{Key: k, Count: v.suppressed})
+		}
+		return true
+	})
+	h.unlock()
+
+	sort.Slice(kcs, func(i, j int) bool {
+		if kcs[i].Count != kcs[j].Count {
+			return kcs[i].Count > kcs[j].Count
+		}
+		return kcs[i].Key < kcs[j].Key
+	})
+	return kcs
+}
+
+func (e *HistoryEntry) olderThan(other *HistoryEntry) bool {
+	if !e.expireTime.Equal(other.expireTime) {
+		return e.expireTime.Before(other.expireTime)
+	}
+	return e.order < other.order
+}
+
+// evictBefore reports whether e should be evicted before other.
+func (h *DedupHandler) evictBefore(e, other *HistoryEntry) bool {
+	if h.opts.EvictionPolicy == EvictionPolicyLowestLevelOldestFirst && e.level != other.level {
+		return e.level < other.level
+	}
+	return e.olderThan(other)
+}
+
+// hottestKey returns the key with the most suppressed records.
+// It returns false if no key has suppressed records.
+func (h *DedupHandler) hottestKey() (string, bool) {
+	var hottestKey string
+	var hottest uint64
+	h.history.Range(func(k string, v *HistoryEntry) bool {
+		if v.suppressed > hottest || (v.suppressed == hottest && hottest > 0 && k < hottestKey) {
+			hottestKey = k
+			hottest = v.suppressed
+		}
+		return true
+	})
+	return hottestKey, hottest > 0
+}
+
+// removeOldestHistory evicts an entry from the history and returns it,
+// so that the caller can reuse it.
+func (h *DedupHandler) removeOldestHistory() *HistoryEntry {
+	key, e := h.oldestHistory()
+	h.deleteHistory(key, e)
+	return e
+}
+
+// oldestHistory returns the entry to be evicted next from the history.
+func (h *DedupHandler) oldestHistory() (string, *HistoryEntry) {
+	protectedKey, protected := "", false
+	if h.opts.ProtectHottestOnEvict && h.history.Len() > 1 {
+		protectedKey, protected = h.hottestKey()
+	}
 	var toBeDeletedKey string
-	toBeDeletedTime := time.Now().Add(h.opts.HistoryRetentionPeriod)
-	for k, v := range h.history {
-		if v.Before(toBeDeletedTime) {
+	var toBeDeleted *HistoryEntry
+	h.history.Range(func(k string, v *HistoryEntry) bool {
+		if protected && k == protectedKey {
+			return true
+		}
+		if toBeDeleted == nil || h.evictBefore(v, toBeDeleted) {
 			toBeDeletedKey = k
-			toBeDeletedTime = v
+			toBeDeleted = v
+		}
+		return true
+	})
+	if toBeDeleted == nil {
+		panic("history should not be empty.")
+	}
+	return toBeDeletedKey, toBeDeleted
+}
+
+// full reports whether the history has reached MaxHistoryCount.
+func (h *DedupHandler) full() bool {
+	return h.history.Len() >= h.opts.MaxHistoryCount
+}
+
+// aboveHighWaterMark reports whether the history has reached HighWaterMark.
+func (h *DedupHandler) aboveHighWaterMark() bool {
+	return h.opts.HighWaterMark > 0 &&
+		float64(h.history.Len()) >= h.opts.HighWaterMark*float64(h.opts.MaxHistoryCount)
+}
+
+// touchHistory returns the history entry for key with the expiration time
+// extended, and whether it is stored in the history. The entry is created if
+// it does not exist, but not stored while the history is full with
+// EvictionPolicyRejectNew.
+func (h *DedupHandler) touchHistory(key string) (*HistoryEntry, bool) {
+	e, ok := h.history.Get(key)
+	if !ok {
+		rejectNew := h.opts.EvictionPolicy == EvictionPolicyRejectNew
+		if h.aboveHighWaterMark() || (rejectNew && h.full()) {
+			h.sweepInline()
+		}
+		if rejectNew && h.full() {
+			return &HistoryEntry{}, false
+		}
+		if h.full() {
+			e = h.removeOldestHistory()
+			h.metrics.IncEvicted()
+			*e = HistoryEntry{}
+		} else {
+			e = &HistoryEntry{}
 		}
+		h.history.Set(key, e)
+		h.metrics.SetHistorySize(h.history.Len())
+		h.stats.HistoryPeak = max(h.stats.HistoryPeak, h.history.Len())
+		e.firstSeen = h.monotonicNow()
+	}
+	e.expireTime = h.monotonicNow().Add(h.opts.HistoryRetentionPeriod)
+	h.updateCount += 1
+	e.order = h.updateCount
+	return e, true
+}
+
+// sweepInline removes the expired history in Handle, at most once per a
+// tenth of CleanupInterval. OnExpire is called for the removed keys when the
+// lock is released.
+func (h *DedupHandler) sweepInline() {
+	if h.monotonicNow().Sub(h.lastInlineSweep) < h.opts.CleanupInterval/10 {
+		return
 	}
-	if toBeDeletedKey == "" {
-		panic("toBeDeletedKey should not be empty.")
+	h.lastInlineSweep = h.monotonicNow()
+	removed := h.removeExpiredHistoryLocked()
+	if h.opts.OnExpire != nil {
+		h.pendingExpired = append(h.pendingExpired, removed...)
 	}
-	delete(h.history, toBeDeletedKey)
-	h.historyCount -= 1
 }
 
-func (h *DedupHandler) updateHistory(msg string) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	if _, ok := h.history[msg]; !ok {
-		if h.historyCount >= h.opts.MaxHistoryCount {
-			h.removeOldestHistory()
+// updateHistory records the emission of r, and returns its sequence number
+// and window ID.
+func (h *DedupHandler) updateHistory(key string, r slog.Record) (uint64, uint64) {
+	h.lock()
+	defer h.unlock()
+	prev, ok := h.history.Get(key)
+	if ok && h.outlived(prev) {
+		h.deleteHistory(key, prev)
+		ok = false
+	}
+	newWindow := !ok || h.expired(prev.expireTime)
+	tenant, hasTenant := h.tenantValue(r)
+	if !ok && hasTenant {
+		h.reserveTenant(tenant)
+	}
+	e, stored := h.touchHistory(key)
+	if !ok && hasTenant && stored {
+		h.setTenant(e, tenant)
+	}
+	if h.opts.AutoTuneRetention {
+		h.observeArrival(e)
+		e.expireTime = h.monotonicNow().Add(h.retention(e))
+	}
+	if newWindow {
+		e.windowID += 1
+	}
+	e.cooldownEnd = time.Time{}
+	if newWindow && h.opts.FirstEmitCooldown > 0 {
+		e.cooldownEnd = h.monotonicNow().Add(h.opts.FirstEmitCooldown)
+	}
+	h.queueSummary(e)
+	e.preloaded = false
+	e.lastEmitted = h.now()
+	if h.opts.EmitOnAttrChange {
+		e.attrsHash = attrsHash(r)
+	}
+	if h.opts.DecayHalfLife > 0 {
+		h.addScore(e)
+	}
+	e.sampleCount = 0
+	e.level = r.Level
+	if h.opts.EmitSummary {
+		e.msg = r.Message
+	}
+	e.seq += 1
+	h.stats.Emitted += 1
+	h.metrics.IncEmitted()
+	if h.opts.SimilarityThreshold > 0 {
+		h.addRecentKey(key)
+	}
+	return e.seq, e.windowID
+}
+
+// Preload inserts msgs into the history as if they had been logged,
+// so that their first records are suppressed.
+// See also HandlerOptions.EmitFirstAfterReset.
+func (h *DedupHandler) Preload(msgs ...string) {
+	h.lock()
+	defer h.unlock()
+	for _, msg := range msgs {
+		e, _ := h.touchHistory(h.key(slog.Record{Message: msg}))
+		if e.seq == 0 {
+			e.preloaded = true
 		}
-		h.historyCount += 1
 	}
-	h.history[msg] = time.Now().Add(h.opts.HistoryRetentionPeriod)
 }
 
+// MergeFrom copies the unexpired history of other into h. For the keys
+// in both, the later expiration time is kept. If h becomes full, the keys
+// expiring first are evicted. The history of other is copied under its
+// lock first, so that the two locks are never held at the same time.
+// It does nothing if h and other share the history by WithAttrs or
+// WithGroup.
+func (h *DedupHandler) MergeFrom(other *DedupHandler) {
+	if h.dedupState == other.dedupState {
+		return
+	}
+	type keyEntry struct {
+		key   string
+		entry HistoryEntry
+	}
+	other.lock()
+	entries := make([]keyEntry, 0, other.history.Len())
+	other.history.Range(func(k string, v *HistoryEntry) bool {
+		if !other.expired(v.expireTime) {
+			entries = append(entries, keyEntry{key: k, entry: *v})
+		}
+		return true
+	})
+	other.unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].entry.olderThan(&entries[j].entry)
+	})
+
+	h.lock()
+	defer h.unlock()
+	for _, ke := range entries {
+		if e, ok := h.history.Get(ke.key); ok {
+			if ke.entry.expireTime.After(e.expireTime) {
+				e.expireTime = ke.entry.expireTime
+			}
+			continue
+		}
+		e, stored := h.touchHistory(ke.key)
+		if !stored {
+			continue
+		}
+		*e = ke.entry
+		h.countTenant(e, 1)
+		e.values = slices.Clone(ke.entry.values)
+		e.levels = slices.Clone(ke.entry.levels)
+		e.examples = slices.Clone(ke.entry.examples)
+		h.updateCount += 1
+		e.order = h.updateCount
+	}
+}
+
+// Flush removes key from the history, and emits its summary if EmitSummary
+// is set. It returns the number of the records suppressed for key while it
+// was in the history, and whether key existed.
+func (h *DedupHandler) Flush(key string) (int, bool) {
+	h.lock()
+	e, ok := h.history.Get(key)
+	if !ok {
+		h.unlock()
+		return 0, false
+	}
+	h.deleteHistory(key, e)
+	h.unlock()
+	_ = h.flushSummaries(h.lifetimeCtx)
+	return int(e.suppressed), true
+}
+
+// Reset removes all the history.
+func (h *DedupHandler) Reset() {
+	h.lock()
+	defer h.unlock()
+	h.history = h.newCache(min(h.opts.MaxHistoryCount, initialHistoryCapacity))
+	h.metrics.SetHistorySize(0)
+	h.stats.HistoryPeak = 0
+	if h.tenantCounts != nil {
+		h.tenantCounts = make(map[string]int)
+	}
+	h.resetDone = true
+}
+
+// SetMaxHistoryCount changes MaxHistoryCount to n, or DefaultMaxHistoryCount
+// if n is not positive. The keys are evicted if the history exceeds it.
+// It is safe to call it while logging. The handlers derived by WithAttrs or
+// WithGroup share it.
+func (h *DedupHandler) SetMaxHistoryCount(n int) {
+	if n <= 0 {
+		n = DefaultMaxHistoryCount
+	}
+	h.lock()
+	defer h.unlock()
+	h.opts.MaxHistoryCount = n
+	if h.history.Len() <= n {
+		return
+	}
+	// Sort the entries once instead of calling removeOldestHistory for
+	// each of them, which scans the whole history.
+	protectedKey, protected := "", false
+	if h.opts.ProtectHottestOnEvict {
+		protectedKey, protected = h.hottestKey()
+	}
+	type keyEntry struct {
+		key   string
+		entry *HistoryEntry
+	}
+	excess := h.history.Len() - n
+	kes := make([]keyEntry, 0, h.history.Len())
+	h.history.Range(func(k string, v *HistoryEntry) bool {
+		if !protected || k != protectedKey {
+			kes = append(kes, keyEntry{key: k, entry: v})
+		}
+		return true
+	})
+	sort.Slice(kes, func(i, j int) bool {
+		return h.evictBefore(kes[i].entry, kes[j].entry)
+	})
+	for _, ke := range kes[:excess] {
+		h.deleteHistory(ke.key, ke.entry)
+		h.metrics.IncEvicted()
+	}
+}
+
+// Reason describes why HandleReport emitted a record or not.
+type Reason int
+
+const (
+	// ReasonEmitted means the record was emitted after the deduplication check.
+	ReasonEmitted Reason = iota
+	// ReasonSuppressedDuplicate means the record was suppressed as a duplicate.
+	ReasonSuppressedDuplicate
+	// ReasonDisabled means the wrapped handler is not enabled for the level.
+	ReasonDisabled
+	// ReasonBypassed means the record was emitted without the deduplication
+	// check because its level is higher than DedupLogLevel, DedupPredicate
+	// returned false, or its level is at or above AlwaysEmitAtOrAbove.
+	ReasonBypassed
+	// ReasonSampled means the record was a duplicate, but emitted as
+	// a sample for SampleEvery.
+	ReasonSampled
+	// ReasonThrottled means the record was suppressed by GlobalMaxEmitRate.
+	ReasonThrottled
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonEmitted:
+		return "Emitted"
+	case ReasonSuppressedDuplicate:
+		return "SuppressedDuplicate"
+	case ReasonDisabled:
+		return "Disabled"
+	case ReasonBypassed:
+		return "Bypassed"
+	case ReasonSampled:
+		return "Sampled"
+	case ReasonThrottled:
+		return "Throttled"
+	}
+	return fmt.Sprintf("Reason(%d)", int(r))
+}
+
+// Handle passes r to the wrapped handler unless it is a duplicate. The zero
+// Record is handled as an INFO record with the empty message.
 func (h *DedupHandler) Handle(ctx context.Context, r slog.Record) error {
-	if r.Level <= h.opts.DedupLogLevel && h.duplicated(r.Message) {
+	_, _, err := h.HandleReport(ctx, r)
+	return err
+}
+
+// HandleReport is the same as Handle, but also reports whether the record
+// was passed to the wrapped handler and the reason.
+func (h *DedupHandler) HandleReport(ctx context.Context, r slog.Record) (bool, Reason, error) {
+	emitted, reason, err := h.handleReport(ctx, r)
+	if h.opts.DecisionRecorder != nil {
+		h.opts.DecisionRecorder.record(Decision{
+			Key:     h.key(r),
+			Emitted: emitted,
+			Reason:  reason,
+			Time:    h.now(),
+		})
+	}
+	return emitted, reason, err
+}
+
+func (h *DedupHandler) handleReport(ctx context.Context, r slog.Record) (bool, Reason, error) {
+	if h.closed.Load() {
+		return false, ReasonDisabled, ErrHandlerClosed
+	}
+	// The records never emitted must not be in the history.
+	if !h.wrappedEnabled(ctx, r.Level) {
+		h.lock()
+		h.stats.Filtered += 1
+		h.unlock()
+		return false, ReasonDisabled, nil
+	}
+	if l := h.opts.AlwaysEmitAtOrAbove; l != nil && r.Level >= *l {
+		h.lock()
+		h.stats.Emitted += 1
+		h.metrics.IncEmitted()
+		h.unlock()
+		return true, ReasonBypassed, h.emit(ctx, r)
+	}
+	if h.inlineCleanup && h.cleanupDue() {
+		_ = h.flushCounts(ctx)
+		if !h.cleanupPaused.Load() {
+			h.removeExpiredHistory()
+		}
+		_ = h.warnHighSuppression(ctx)
+	}
+	key := h.key(r)
+	if h.opts.ApproximateMode {
+		return h.handleApproximately(ctx, key, r)
+	}
+	if h.opts.ConsecutiveOnly {
+		return h.handleConsecutively(ctx, key, r)
+	}
+	reason := ReasonBypassed
+	if h.dedupEligible(ctx, r) {
+		dup, sampledOf := h.duplicated(key, r)
+		if dup {
+			return false, ReasonSuppressedDuplicate, h.overflow(ctx, key, r)
+		}
+		if sampledOf > 0 {
+			r = withAddedAttrs(r, slog.Uint64(SampledOfKey, sampledOf))
+			r = withAddedAttrs(r, h.keyHashAttrs(key)...)
+			return true, ReasonSampled, h.emit(ctx, r)
+		}
+		reason = ReasonEmitted
+	}
+	if !h.allowEmit() {
+		h.lock()
+		h.stats.Throttled += 1
+		h.unlock()
+		return false, ReasonThrottled, h.dryRunEmit(ctx, r)
+	}
+	seq, windowID := h.updateHistory(key, r)
+	var attrs []slog.Attr
+	if h.opts.AddSequence {
+		attrs = append(attrs, slog.Uint64(SequenceKey, seq))
+	}
+	if h.opts.AddWindowID {
+		attrs = append(attrs, slog.Uint64(WindowIDKey, windowID))
+	}
+	attrs = append(attrs, h.keyHashAttrs(key)...)
+	r = withAddedAttrs(r, attrs...)
+	if err := h.flushSummaries(ctx); err != nil {
+		return true, reason, errors.Join(err, h.emit(ctx, r))
+	}
+	return true, reason, h.emit(ctx, r)
+}
+
+// newSyntheticRecord creates a record generated by the handler.
+func (h *DedupHandler) newSyntheticRecord(t time.Time, level slog.Level, msg string) slog.Record {
+	r := slog.NewRecord(t, level, msg, 0)
+	if h.opts.Name != "" {
+		r.AddAttrs(slog.String(HandlerNameKey, h.opts.Name))
+	}
+	return r
+}
+
+// withAddedAttrs returns a clone of r with attrs added. The record of the
+// caller must not be modified because it may be reused.
+func withAddedAttrs(r slog.Record, attrs ...slog.Attr) slog.Record {
+	if len(attrs) == 0 {
+		return r
+	}
+	r = r.Clone()
+	r.AddAttrs(attrs...)
+	return r
+}
+
+// dedupEligible reports whether r is subject to the deduplication.
+func (h *DedupHandler) dedupEligible(ctx context.Context, r slog.Record) bool {
+	if r.Level > h.opts.DedupLogLevel ||
+		(h.opts.DedupLogLevelExclusive && r.Level == h.opts.DedupLogLevel) {
+		return false
+	}
+	return h.opts.DedupPredicate == nil || h.opts.DedupPredicate(ctx, r)
+}
+
+// wrappedHandler is a wrapped handler built from base.
+type wrappedHandler struct {
+	base    *slog.Handler
+	handler slog.Handler
+}
+
+// derivation is the argument of WithAttrs, or of WithGroup if group is set.
+type derivation struct {
+	attrs []slog.Attr
+	group string
+}
+
+// wrapped returns the wrapped handler. If the base handler has been replaced
+// by SetHandler, the derivations are applied to the new one.
+func (h *DedupHandler) wrapped() slog.Handler {
+	base := h.base.Load()
+	if len(h.derivations) == 0 {
+		return *base
+	}
+	if w := h.handler.Load(); w != nil && w.base == base {
+		return w.handler
+	}
+	handler := *base
+	if handler != nil {
+		for _, d := range h.derivations {
+			if d.group != "" {
+				handler = handler.WithGroup(d.group)
+			} else {
+				handler = handler.WithAttrs(d.attrs)
+			}
+		}
+	}
+	h.handler.Store(&wrappedHandler{base: base, handler: handler})
+	return handler
+}
+
+// SetHandler replaces the wrapped handler with inner. The history and the
+// background cleanup are kept. The handlers derived by WithAttrs or
+// WithGroup share inner, wrapping it with their attributes and groups, and
+// calling SetHandler on any of them replaces it for all.
+func (h *DedupHandler) SetHandler(inner slog.Handler) {
+	h.base.Store(&inner)
+}
+
+// emit passes r to the wrapped handler, waiting at most EmitTimeout.
+func (h *DedupHandler) emit(ctx context.Context, r slog.Record) error {
+	handler := h.wrapped()
+	if h.queue != nil {
+		return h.enqueue(ctx, handler, r)
+	}
+	if h.opts.EmitTimeout <= 0 {
+		return handler.Handle(ctx, r)
+	}
+	select {
+	case h.pendingEmits <- struct{}{}:
+	default:
+		// The wrapped handler is likely blocked by the earlier calls.
+		h.countEmitTimeout()
+		return ErrEmitTimeout
+	}
+	done := make(chan error, 1)
+	r = r.Clone()
+	go func() {
+		defer func() { <-h.pendingEmits }()
+		done <- handler.Handle(ctx, r)
+	}()
+	timer := time.NewTimer(h.opts.EmitTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		h.countEmitTimeout()
+		return ErrEmitTimeout
+	}
+}
+
+func (h *DedupHandler) countEmitTimeout() {
+	h.lock()
+	h.stats.EmitTimeouts += 1
+	h.unlock()
+}
+
+// KeyFor returns the key h uses to deduplicate r, to verify the options
+// such as Normalizer and EventKeyAttrs. It does not change the state of h.
+// ctx is not used for now.
+func (h *DedupHandler) KeyFor(ctx context.Context, r slog.Record) string {
+	return h.key(r)
+}
+
+func (h *DedupHandler) key(r slog.Record) string {
+	key, ok := h.eventKey(r)
+	if !ok {
+		key = h.messageKey(r.Message)
+	}
+	if h.opts.KeyByMessageAndAttrs {
+		key += "\x00" + attrsKey(r)
+	}
+	if len(h.opts.DimensionAttrs) > 0 {
+		key += h.dimensionKey(r)
+	}
+	if h.opts.KeyBySource && r.PC != 0 {
+		key = sourceOf(r.PC) + "\x00" + key
+	}
+	if scope, ok := h.scopeValue(r); ok {
+		key = scope + "\x00" + key
+	}
+	if tenant, ok := h.tenantValue(r); ok {
+		key = tenant + "\x00" + key
+	}
+	if bucket := h.calendarBucket(); bucket != "" {
+		key += "\x00" + bucket
+	}
+	return h.saltKey(h.truncateKey(key))
+}
+
+// messageKey returns the message transformed for the key.
+func (h *DedupHandler) messageKey(msg string) string {
+	if h.opts.StripANSI {
+		msg = stripANSI(msg)
+	}
+	if h.opts.Normalizer != nil {
+		msg = h.opts.Normalizer(msg)
+	}
+	if h.opts.StripPlaceholders {
+		msg = stripPlaceholders(msg)
+	}
+	msg = h.stripTokens(msg)
+	if h.opts.MaskDigits {
+		msg = maskDigits(msg)
+	}
+	if h.opts.KeyPrefixLength > 0 {
+		msg = runePrefix(msg, h.opts.KeyPrefixLength)
+	}
+	return msg
+}
+
+// runePrefix returns the first n runes of s.
+func runePrefix(s string, n int) string {
+	count := 0
+	for i := range s {
+		if count == n {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+// eventKey returns the key built from EventAttr and EventKeyAttrs.
+// It returns false if r does not have EventAttr. The key starts with
+// "\x00" so that it never collides with the messages.
+func (h *DedupHandler) eventKey(r slog.Record) (string, bool) {
+	if h.opts.EventAttr == "" {
+		return "", false
+	}
+	event, ok := findAttr(r, h.opts.EventAttr)
+	if !ok {
+		return "", false
+	}
+	var sb strings.Builder
+	sb.WriteString("\x00")
+	sb.WriteString(event.String())
+	for _, k := range h.opts.EventKeyAttrs {
+		sb.WriteString("\x00")
+		if v, ok := findAttr(r, k); ok {
+			sb.WriteString(v.String())
+		}
+	}
+	return sb.String(), true
+}
+
+// keyHashAttrs returns the KeyHashKey attribute for key
+// if AddKeyHashAttr is set.
+func (h *DedupHandler) keyHashAttrs(key string) []slog.Attr {
+	if !h.opts.AddKeyHashAttr {
 		return nil
 	}
-	h.updateHistory(r.Message)
-	return h.handler.Handle(ctx, r)
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	return []slog.Attr{slog.String(KeyHashKey, fmt.Sprintf("%016x", f.Sum64()))}
+}
+
+// saltKey returns the hex-encoded HMAC of key if KeySalt is set.
+func (h *DedupHandler) saltKey(key string) string {
+	if len(h.opts.KeySalt) == 0 {
+		return key
+	}
+	mac := hmac.New(sha256.New, h.opts.KeySalt)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// stripTokens removes the leading and trailing tokens of msg
+// as configured.
+func (h *DedupHandler) stripTokens(msg string) string {
+	if !h.opts.StripLeadingToken && !h.opts.StripTrailingToken {
+		return msg
+	}
+	msg = strings.TrimSpace(msg)
+	if h.opts.StripLeadingToken {
+		if i := strings.IndexFunc(msg, unicode.IsSpace); i >= 0 {
+			msg = strings.TrimLeftFunc(msg[i:], unicode.IsSpace)
+		}
+	}
+	if h.opts.StripTrailingToken {
+		if i := strings.LastIndexFunc(msg, unicode.IsSpace); i >= 0 {
+			msg = strings.TrimRightFunc(msg[:i], unicode.IsSpace)
+		}
+	}
+	return msg
+}
+
+// truncateKey shortens key to MaxKeyLength. The result is at least
+// as long as the hash, even if MaxKeyLength is shorter than it.
+func (h *DedupHandler) truncateKey(key string) string {
+	if h.opts.MaxKeyLength == 0 || len(key) <= h.opts.MaxKeyLength {
+		return key
+	}
+	const hashLen = 16
+	n := max(h.opts.MaxKeyLength-hashLen, 0)
+	f := fnv.New64a()
+	f.Write([]byte(key[n:]))
+	return fmt.Sprintf("%s%0*x", key[:n], hashLen, f.Sum64())
+}
+
+// scopeValue returns the value of the ScopeAttr attribute in r,
+// or in the attributes given by WithAttrs if r does not have it.
+func (h *DedupHandler) scopeValue(r slog.Record) (string, bool) {
+	if h.opts.ScopeAttr == "" {
+		return "", false
+	}
+	if v, ok := findAttr(r, h.opts.ScopeAttr); ok {
+		return v.String(), true
+	}
+	return h.scope, h.hasScope
+}
+
+func (h *DedupHandler) calendarBucket() string {
+	loc := h.opts.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	switch h.opts.CalendarBucket {
+	case CalendarBucketHourly:
+		return h.now().In(loc).Format("2006-01-02T15")
+	case CalendarBucketDaily:
+		return h.now().In(loc).Format("2006-01-02")
+	}
+	return ""
 }
 
+func (h *DedupHandler) overflow(ctx context.Context, key string, r slog.Record) error {
+	if h.opts.DryRun {
+		return h.dryRunEmit(ctx, r)
+	}
+	h.audit(ctx, key, r)
+	// The warning is not the record itself, so its error does not keep
+	// the record from reaching the handlers below.
+	warnErr := h.warnHighSuppression(ctx)
+	if l := h.opts.DowngradeInsteadOfDrop; l != nil && h.wrappedEnabled(ctx, *l) {
+		dr := r.Clone()
+		dr.Level = *l
+		if err := h.emit(ctx, dr); err != nil {
+			return errors.Join(warnErr, err)
+		}
+	}
+	if h.opts.DebugSuppressed && h.wrappedEnabled(ctx, slog.LevelDebug) {
+		dr := r.Clone()
+		dr.Level = slog.LevelDebug
+		dr.AddAttrs(slog.Bool(SuppressedKey, true))
+		if err := h.emit(ctx, dr); err != nil {
+			return errors.Join(warnErr, err)
+		}
+	}
+	if h.overflowHandler == nil || !h.overflowHandler.Enabled(ctx, r.Level) {
+		return warnErr
+	}
+	err := h.overflowHandler.Handle(ctx, r)
+	if h.opts.IgnoreOverflowErrors {
+		return warnErr
+	}
+	return errors.Join(warnErr, err)
+}
+
+// WithAttrs returns a DedupHandler wrapping the handler with attrs. It shares
+// the history, the stats and the background cleanup with h, so that the
+// duplicates logged through the derived handlers are suppressed together.
 func (h *DedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	return NewDedupHandler(h.ctx, h.handler.WithAttrs(attrs), &h.opts)
+	nh := h.derive(derivation{attrs: slices.Clip(attrs)})
+	if nh.overflowHandler != nil {
+		nh.overflowHandler = nh.overflowHandler.WithAttrs(attrs)
+	}
+	nh.dimensions = h.withDimensions(attrs)
+	for _, a := range attrs {
+		if h.opts.ScopeAttr != "" && a.Key == h.opts.ScopeAttr {
+			nh.scope, nh.hasScope = a.Value.String(), true
+		}
+		if h.opts.TenantAttr != "" && a.Key == h.opts.TenantAttr {
+			nh.tenant, nh.hasTenant = a.Value.String(), true
+		}
+	}
+	return nh
 }
 
+// WithGroup returns a DedupHandler wrapping the handler with the group name.
+// Like WithAttrs, it shares the state with h.
 func (h *DedupHandler) WithGroup(name string) slog.Handler {
-	return NewDedupHandler(h.ctx, h.handler.WithGroup(name), &h.opts)
+	nh := h.derive(derivation{group: name})
+	if nh.overflowHandler != nil {
+		nh.overflowHandler = nh.overflowHandler.WithGroup(name)
+	}
+	return nh
+}
+
+// derive returns a DedupHandler with the state of h and d added to the
+// derivations.
+func (h *DedupHandler) derive(d derivation) *DedupHandler {
+	nh := &DedupHandler{
+		dedupState:      h.dedupState,
+		derivations:     append(slices.Clip(h.derivations), d),
+		overflowHandler: h.overflowHandler,
+		scope:           h.scope,
+		hasScope:        h.hasScope,
+		tenant:          h.tenant,
+		hasTenant:       h.hasTenant,
+		dimensions:      h.dimensions,
+	}
+	nh.wrapped()
+	return nh
 }
@@ -4,7 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -68,12 +77,14 @@ func TestDedupLogWithAttrsAndGroup(t *testing.T) {
 	logger.Info("test")
 	assert.Empty(t, b.String())
 
-	// New logger is not related with the original logger,
-	// but the option of the wrapped handler is inherited.
+	// New logger shares the history with the original logger,
+	// and the option of the wrapped handler is inherited.
 	b.Reset()
 	loggerWithAG := logger.WithGroup("g1").With("key1", "value1")
 	loggerWithAG.Info("test", "key2", "value2")
-	expectedMsg = "test"
+	assert.Empty(t, b.String())
+	loggerWithAG.Info("test3", "key2", "value2")
+	expectedMsg = "test3"
 	jsonLog = make(map[string]any)
 	err = json.Unmarshal(b.Bytes(), &jsonLog)
 	require.NoError(t, err)
@@ -151,3 +162,2328 @@ func TestDedupLogLevel(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, expectedMsg, jsonLog["msg"])
 }
+
+func TestOverflowHandler(t *testing.T) {
+	b := new(bytes.Buffer)
+	ob := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			OverflowHandler:        slog.NewJSONHandler(ob, nil),
+		}))
+	require.NotNil(t, logger)
+
+	logger.Info("test")
+	expectedMsg := "test"
+	jsonLog := make(map[string]string)
+	err := json.Unmarshal(b.Bytes(), &jsonLog)
+	require.NoError(t, err)
+	assert.Equal(t, expectedMsg, jsonLog["msg"])
+	assert.Empty(t, ob.String())
+
+	// The duplicated log goes to the overflow handler.
+	b.Reset()
+	logger.Info("test")
+	assert.Empty(t, b.String())
+	jsonLog = make(map[string]string)
+	err = json.Unmarshal(ob.Bytes(), &jsonLog)
+	require.NoError(t, err)
+	assert.Equal(t, expectedMsg, jsonLog["msg"])
+}
+
+type ctxKey struct{}
+
+type ctxRecordingHandler struct {
+	slog.Handler
+	values []any
+}
+
+func (h *ctxRecordingHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.values = append(h.values, ctx.Value(ctxKey{}))
+	return h.Handler.Handle(ctx, r)
+}
+
+func TestHandleUsesPerCallContext(t *testing.T) {
+	b := new(bytes.Buffer)
+	rh := &ctxRecordingHandler{Handler: slog.NewJSONHandler(b, nil)}
+	lifetimeCtx := context.WithValue(context.Background(), ctxKey{}, "lifetime")
+	logger := slog.New(NewDedupHandler(lifetimeCtx, rh,
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		}))
+	require.NotNil(t, logger)
+
+	callCtx := context.WithValue(context.Background(), ctxKey{}, "call")
+	logger.InfoContext(callCtx, "test")
+	require.Len(t, rh.values, 1)
+	assert.Equal(t, "call", rh.values[0])
+}
+
+func TestAddSequence(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Millisecond * 10,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			AddSequence:            true,
+		}))
+	require.NotNil(t, logger)
+
+	for _, expectedSeq := range []float64{1, 2} {
+		b.Reset()
+		logger.Info("test")
+		jsonLog := make(map[string]any)
+		err := json.Unmarshal(b.Bytes(), &jsonLog)
+		require.NoError(t, err)
+		assert.Equal(t, "test", jsonLog["msg"])
+		assert.Equal(t, expectedSeq, jsonLog[SequenceKey])
+
+		// The same log is deduplicated until the history expires.
+		b.Reset()
+		logger.Info("test")
+		assert.Empty(t, b.String())
+		time.Sleep(time.Millisecond * 15)
+	}
+}
+
+func TestNewDedupHandlerChecked(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    *HandlerOptions
+		wantErr bool
+	}{
+		{
+			name: "nil options",
+			opts: nil,
+		},
+		{
+			name: "valid options",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				CleanupInterval:        time.Second,
+			},
+		},
+		{
+			name: "negative retention period",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: -time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+			},
+			wantErr: true,
+		},
+		{
+			name: "zero max history count",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        0,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative max history count",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative cleanup interval",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				CleanupInterval:        -time.Second,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative max key length",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				MaxKeyLength:           -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative emit timeout",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				EmitTimeout:            -time.Second,
+			},
+			wantErr: true,
+		},
+		{
+			name: "false positive rate out of range",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				FalsePositiveRate:      1.5,
+			},
+			wantErr: true,
+		},
+		{
+			name: "spike threshold without window",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				SpikeThreshold:         3,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative MaxKeyLifetime",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				MaxKeyLifetime:         -time.Second,
+			},
+			wantErr: true,
+		},
+		{
+			name: "too large SimilarityThreshold",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				SimilarityThreshold:    1.5,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative SimilarityCandidates",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				SimilarityCandidates:   -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "too large HighWaterMark",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				HighWaterMark:          1.5,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative AsyncQueueSize",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				AsyncQueueSize:         -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative SampleEvery",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				SampleEvery:            -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "MinRetention greater than MaxRetention",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				MinRetention:           time.Hour,
+				MaxRetention:           time.Second,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative GlobalMaxEmitRate",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				GlobalMaxEmitRate:      -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative FirstEmitCooldown",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				FirstEmitCooldown:      -time.Second,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative MaxHistoryCountPerTenant",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod:   time.Minute,
+				MaxHistoryCount:          DefaultMaxHistoryCount,
+				MaxHistoryCountPerTenant: -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative KeyPrefixLength",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				KeyPrefixLength:        -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative SummaryExamples",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				SummaryExamples:        -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "CompactionThreshold too large",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				CompactionThreshold:    1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative HighSuppressionWarnRatio",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod:   time.Minute,
+				MaxHistoryCount:          DefaultMaxHistoryCount,
+				HighSuppressionWarnRatio: -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative DecayHalfLife",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				DecayHalfLife:          -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative ScoreThreshold",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				ScoreThreshold:         -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative MetricsTopK",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				MetricsTopK:            -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "AsyncEmit with Unsynchronized",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				AsyncEmit:              true,
+				Unsynchronized:         true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative MaxPendingEmits",
+			opts: &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				MaxPendingEmits:        -1,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := NewDedupHandlerChecked(context.Background(),
+				slog.NewJSONHandler(new(bytes.Buffer), nil), tc.opts)
+			if tc.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, h)
+				return
+			}
+			require.NoError(t, err)
+			assert.NotNil(t, h)
+		})
+	}
+}
+
+func TestNewDedupHandlerClampsInvalidOptions(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(new(bytes.Buffer), nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: -time.Minute,
+			MaxHistoryCount:        -1,
+			CleanupInterval:        -time.Second,
+		})
+	assert.Equal(t, DefaultHistoryRetentionPeriod, h.opts.HistoryRetentionPeriod)
+	assert.Equal(t, DefaultMaxHistoryCount, h.opts.MaxHistoryCount)
+	assert.Equal(t, DefaultCleanupInterval, h.opts.CleanupInterval)
+}
+
+func TestCalendarBucketDaily(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	require.NoError(t, err)
+
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Hour * 48,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CalendarBucket:         CalendarBucketDaily,
+			Location:               loc,
+		})
+	now := time.Date(2024, 1, 1, 23, 0, 0, 0, loc)
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	logger.Info("test")
+	assert.NotEmpty(t, b.String())
+
+	// The same log is deduplicated within the same local day,
+	// even though the UTC date has not changed.
+	b.Reset()
+	now = now.Add(time.Minute * 59)
+	logger.Info("test")
+	assert.Empty(t, b.String())
+
+	// The log is emitted again after the local midnight.
+	b.Reset()
+	now = now.Add(time.Minute * 2)
+	logger.Info("test")
+	expectedMsg := "test"
+	jsonLog := make(map[string]string)
+	err = json.Unmarshal(b.Bytes(), &jsonLog)
+	require.NoError(t, err)
+	assert.Equal(t, expectedMsg, jsonLog["msg"])
+}
+
+func TestCalendarBucketHourlyAcrossDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Hour * 3,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CalendarBucket:         CalendarBucketHourly,
+			Location:               loc,
+		})
+	// 2024-03-10 01:30 EST. The clock jumps from 02:00 to 03:00 EDT.
+	now := time.Date(2024, 3, 10, 1, 30, 0, 0, loc)
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	logger.Info("test")
+	assert.NotEmpty(t, b.String())
+
+	b.Reset()
+	now = now.Add(time.Minute * 20)
+	logger.Info("test")
+	assert.Empty(t, b.String())
+
+	// 30 minutes later, it is 03:20 EDT in the next local hour.
+	b.Reset()
+	now = now.Add(time.Minute * 30)
+	logger.Info("test")
+	assert.NotEmpty(t, b.String())
+}
+
+func TestTopSuppressed(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(new(bytes.Buffer), nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+	logger := slog.New(h)
+
+	for msg, count := range map[string]int{"a": 3, "b": 5, "c": 1, "d": 2} {
+		for i := 0; i < count+1; i++ {
+			logger.Info(msg)
+		}
+	}
+	logger.Info("e")
+
+	assert.Equal(t, []KeyCount{
+		{Key: "b", Count: 5},
+		{Key: "a", Count: 3},
+		{Key: "d", Count: 2},
+	}, h.TopSuppressed(3))
+	assert.Len(t, h.TopSuppressed(10), 4)
+	assert.Empty(t, h.TopSuppressed(0))
+}
+
+func TestEvictionOrderWithinSameClockTick(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(new(bytes.Buffer), nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        3,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	for i := 0; i < 100; i++ {
+		logger.Info(fmt.Sprintf("test%d", i))
+	}
+	// Touching test97 makes test98 the oldest.
+	logger.Warn("test97")
+	logger.Info("test100")
+
+	assert.Len(t, h.history, 3)
+	for _, key := range []string{"test97", "test99", "test100"} {
+		assert.Contains(t, h.history, key)
+	}
+}
+
+func TestUnsynchronized(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Millisecond * 10,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			Unsynchronized:         true,
+		}))
+	require.NotNil(t, logger)
+
+	logger.Info("test")
+	assert.NotEmpty(t, b.String())
+
+	b.Reset()
+	logger.Info("test")
+	assert.Empty(t, b.String())
+
+	time.Sleep(time.Millisecond * 15)
+	b.Reset()
+	logger.Info("test")
+	assert.NotEmpty(t, b.String())
+}
+
+func TestHandleReport(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+	ctx := context.Background()
+
+	testCases := []struct {
+		name           string
+		level          slog.Level
+		expectedOK     bool
+		expectedReason Reason
+	}{
+		{name: "first", level: slog.LevelInfo, expectedOK: true, expectedReason: ReasonEmitted},
+		{name: "duplicated", level: slog.LevelInfo, expectedOK: false, expectedReason: ReasonSuppressedDuplicate},
+		{name: "disabled", level: slog.LevelDebug, expectedOK: false, expectedReason: ReasonDisabled},
+		{name: "bypassed", level: slog.LevelWarn, expectedOK: true, expectedReason: ReasonBypassed},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b.Reset()
+			ok, reason, err := h.HandleReport(ctx, slog.NewRecord(time.Now(), tc.level, "test", 0))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedOK, ok)
+			assert.Equal(t, tc.expectedReason, reason)
+			assert.Equal(t, tc.expectedOK, b.Len() > 0)
+		})
+	}
+}
+
+func TestPreloadAndReset(t *testing.T) {
+	for _, emitFirstAfterReset := range []bool{false, true} {
+		t.Run(fmt.Sprintf("EmitFirstAfterReset=%t", emitFirstAfterReset), func(t *testing.T) {
+			b := new(bytes.Buffer)
+			h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+				&HandlerOptions{
+					HistoryRetentionPeriod: time.Minute,
+					MaxHistoryCount:        DefaultMaxHistoryCount,
+					EmitFirstAfterReset:    emitFirstAfterReset,
+				})
+			logger := slog.New(h)
+
+			// The preloaded log is deduplicated.
+			h.Preload("test1", "test2")
+			logger.Info("test1")
+			assert.Empty(t, b.String())
+
+			// The log is emitted after Reset.
+			h.Reset()
+			logger.Info("test2")
+			assert.NotEmpty(t, b.String())
+
+			// The log preloaded after Reset is emitted only if EmitFirstAfterReset is set.
+			b.Reset()
+			h.Preload("test1")
+			logger.Info("test1")
+			assert.Equal(t, emitFirstAfterReset, b.Len() > 0)
+
+			// The second log is deduplicated in any case.
+			b.Reset()
+			logger.Info("test1")
+			assert.Empty(t, b.String())
+		})
+	}
+}
+
+func TestScopeAttr(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			ScopeAttr:              "trace_id",
+		}))
+	require.NotNil(t, logger)
+
+	for _, traceID := range []string{"trace1", "trace2"} {
+		// The first log in each scope is not deduplicated.
+		b.Reset()
+		logger.Info("test", "trace_id", traceID)
+		assert.NotEmpty(t, b.String())
+
+		b.Reset()
+		logger.Info("test", "trace_id", traceID)
+		assert.Empty(t, b.String())
+	}
+
+	// The log without the scope attribute is in the global scope.
+	b.Reset()
+	logger.Info("test")
+	assert.NotEmpty(t, b.String())
+	b.Reset()
+	logger.Info("test")
+	assert.Empty(t, b.String())
+}
+
+func TestMaxKeyLength(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			MaxKeyLength:           64,
+		})
+	logger := slog.New(h)
+
+	longMsg := strings.Repeat("a", 1024*1024)
+	logger.Info(longMsg + "1")
+	jsonLog := make(map[string]string)
+	err := json.Unmarshal(b.Bytes(), &jsonLog)
+	require.NoError(t, err)
+	assert.Equal(t, longMsg+"1", jsonLog["msg"])
+
+	b.Reset()
+	logger.Info(longMsg + "1")
+	assert.Empty(t, b.String())
+
+	// The messages sharing the truncated prefix are distinguished.
+	b.Reset()
+	logger.Info(longMsg + "2")
+	assert.NotEmpty(t, b.String())
+
+	require.Len(t, h.history, 2)
+	h.history.Range(func(k string, _ *HistoryEntry) bool {
+		assert.Len(t, k, 64)
+		return true
+	})
+}
+
+func TestEvictionPolicyLowestLevelOldestFirst(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(),
+		slog.NewJSONHandler(b, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		}),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        3,
+			EvictionPolicy:         EvictionPolicyLowestLevelOldestFirst,
+		})
+	logger := slog.New(h)
+
+	logger.Error("error")
+	time.Sleep(time.Millisecond * 5)
+	logger.Debug("debug")
+	time.Sleep(time.Millisecond * 5)
+	logger.Info("info")
+	time.Sleep(time.Millisecond * 5)
+	logger.Info("new")
+
+	// The debug log is evicted though the error log is older.
+	assert.Contains(t, h.history, "error")
+	assert.NotContains(t, h.history, "debug")
+	assert.Contains(t, h.history, "info")
+	assert.Contains(t, h.history, "new")
+}
+
+type blockingHandler struct {
+	slog.Handler
+	unblock chan struct{}
+}
+
+func (h *blockingHandler) Handle(ctx context.Context, r slog.Record) error {
+	<-h.unblock
+	return h.Handler.Handle(ctx, r)
+}
+
+func TestEmitTimeout(t *testing.T) {
+	bh := &blockingHandler{
+		Handler: slog.NewJSONHandler(io.Discard, nil),
+		unblock: make(chan struct{}),
+	}
+	defer close(bh.unblock)
+	h := NewDedupHandler(context.Background(), bh,
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			EmitTimeout:            time.Millisecond * 10,
+		})
+
+	start := time.Now()
+	err := h.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "test", 0))
+	assert.ErrorIs(t, err, ErrEmitTimeout)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, int64(1), h.Stats().EmitTimeouts)
+}
+
+func TestMaxPendingEmits(t *testing.T) {
+	bh := &blockingHandler{
+		Handler: slog.NewJSONHandler(io.Discard, nil),
+		unblock: make(chan struct{}),
+	}
+	defer close(bh.unblock)
+	h := NewDedupHandler(context.Background(), bh,
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			EmitTimeout:            time.Millisecond,
+			MaxPendingEmits:        4,
+		})
+	defer h.Close()
+
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		err := h.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, fmt.Sprintf("test %d", i), 0))
+		assert.ErrorIs(t, err, ErrEmitTimeout)
+	}
+	// The calls blocked in the wrapped handler are bounded.
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines+4)
+	assert.Equal(t, int64(100), h.Stats().EmitTimeouts)
+}
+
+func TestConfig(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			DedupLogLevel: slog.LevelWarn,
+			AddSequence:   true,
+		})
+	assert.Equal(t, HandlerOptions{
+		HistoryRetentionPeriod: DefaultHistoryRetentionPeriod,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+		DedupLogLevel:          slog.LevelWarn,
+		CleanupInterval:        DefaultCleanupInterval,
+		AddSequence:            true,
+		MaxSummaryValues:       DefaultMaxSummaryValues,
+		ExpectedCardinality:    DefaultExpectedCardinality,
+		FalsePositiveRate:      DefaultFalsePositiveRate,
+		HitRatioWindow:         DefaultHitRatioWindow,
+		SimilarityCandidates:   DefaultSimilarityCandidates,
+		AsyncQueueSize:         DefaultAsyncQueueSize,
+		ScoreThreshold:         DefaultScoreThreshold,
+		MaxPendingEmits:        DefaultMaxPendingEmits,
+	}, h.Config())
+}
+
+func TestEmitOnLevelEscalation(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			DedupLogLevel:          slog.LevelError,
+			EmitOnLevelEscalation:  true,
+		}))
+	require.NotNil(t, logger)
+
+	logger.Info("test")
+	assert.NotEmpty(t, b.String())
+
+	b.Reset()
+	logger.Info("test")
+	assert.Empty(t, b.String())
+
+	// The escalated log is emitted.
+	b.Reset()
+	logger.Error("test")
+	jsonLog := make(map[string]string)
+	err := json.Unmarshal(b.Bytes(), &jsonLog)
+	require.NoError(t, err)
+	assert.Equal(t, "ERROR", jsonLog["level"])
+
+	// The logs up to the escalated level are deduplicated again.
+	b.Reset()
+	logger.Error("test")
+	logger.Warn("test")
+	assert.Empty(t, b.String())
+}
+
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// setClock replaces the clock of h. It is safe even if the background
+// cleanup is running.
+func setClock(h *DedupHandler, c *fakeClock) {
+	h.lock()
+	defer h.unlock()
+	h.now = c.Now
+}
+
+func historyLen(h *DedupHandler) int {
+	h.lock()
+	defer h.unlock()
+	return h.history.Len()
+}
+
+func TestPauseCleanup(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CleanupInterval:        time.Millisecond,
+		})
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	logger.Info("test")
+	h.PauseCleanup()
+	h.PauseCleanup()
+	clock.Advance(time.Minute * 2)
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(t, 1, historyLen(h))
+
+	h.ResumeCleanup()
+	h.ResumeCleanup()
+	assert.Eventually(t, func() bool {
+		return historyLen(h) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestSweepHealth(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CleanupInterval:        time.Millisecond * 10,
+		})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+
+	assert.Eventually(t, func() bool {
+		return h.SweepCount() >= 1
+	}, time.Second, time.Millisecond)
+	count := h.SweepCount()
+	last := h.LastSweepTime()
+	assert.False(t, last.IsZero())
+
+	clock.Advance(time.Second)
+	assert.Eventually(t, func() bool {
+		return h.SweepCount() >= count+2
+	}, time.Second, time.Millisecond)
+	assert.True(t, h.LastSweepTime().After(last))
+}
+
+func TestProtectHottestOnEvict(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        3,
+			ProtectHottestOnEvict:  true,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	logger.Info("hot")
+	logger.Info("hot")
+	logger.Info("hot")
+	now = now.Add(time.Second)
+	logger.Info("cold")
+	logger.Info("cold")
+	now = now.Add(time.Second)
+	logger.Info("new1")
+	now = now.Add(time.Second)
+	logger.Info("new2")
+
+	// The oldest but hottest key survives.
+	assert.Contains(t, h.history, "hot")
+	assert.NotContains(t, h.history, "cold")
+	assert.Contains(t, h.history, "new1")
+	assert.Contains(t, h.history, "new2")
+}
+
+func TestDedupPredicate(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			DedupPredicate: func(ctx context.Context, r slog.Record) bool {
+				_, always := findAttr(r, "always")
+				return !always && r.Message != "never"
+			},
+		})
+	ctx := context.Background()
+
+	testCases := []struct {
+		name           string
+		level          slog.Level
+		msg            string
+		attrs          []slog.Attr
+		expectedReason Reason
+	}{
+		{name: "eligible", level: slog.LevelInfo, msg: "test", expectedReason: ReasonSuppressedDuplicate},
+		{name: "predicate false by message", level: slog.LevelInfo, msg: "never", expectedReason: ReasonBypassed},
+		{name: "predicate false by attr", level: slog.LevelInfo, msg: "test",
+			attrs: []slog.Attr{slog.Bool("always", true)}, expectedReason: ReasonBypassed},
+		{name: "above DedupLogLevel", level: slog.LevelWarn, msg: "test", expectedReason: ReasonBypassed},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				r := slog.NewRecord(time.Now(), tc.level, tc.msg, 0)
+				r.AddAttrs(tc.attrs...)
+				_, reason, err := h.HandleReport(ctx, r)
+				require.NoError(t, err)
+				if i == 1 {
+					assert.Equal(t, tc.expectedReason, reason)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeFrom(t *testing.T) {
+	newHandler := func(now *time.Time) *DedupHandler {
+		h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+			&HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        3,
+			})
+		h.now = func() time.Time { return *now }
+		return h
+	}
+	now := time.Now()
+	h1 := newHandler(&now)
+	h2 := newHandler(&now)
+	logger1 := slog.New(h1)
+	logger2 := slog.New(h2)
+
+	logger2.Info("expired")
+	now = now.Add(time.Second * 30)
+	logger1.Info("common")
+	logger1.Info("only1")
+	now = now.Add(time.Second * 31)
+	logger2.Info("common")
+	logger2.Info("only2")
+
+	h1.MergeFrom(h2)
+	h1.MergeFrom(h1)
+	assert.Len(t, h1.history, 3)
+	assert.NotContains(t, h1.history, "expired")
+	for _, key := range []string{"common", "only1", "only2"} {
+		assert.Contains(t, h1.history, key)
+	}
+	// The later expiration time is kept.
+	common, ok := h1.history.Get("common")
+	require.True(t, ok)
+	assert.WithinDuration(t, now.Add(time.Minute), common.expireTime, time.Second)
+	// The source is not changed.
+	assert.Len(t, h2.history, 3)
+}
+
+func TestSpikeDetection(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Hour,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			SpikeThreshold:         3,
+			SpikeWindow:            time.Second,
+			SpikeCooldown:          time.Minute,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+	countLines := func() int {
+		n := bytes.Count(b.Bytes(), []byte("\n"))
+		b.Reset()
+		return n
+	}
+
+	// Quiet duplicates are suppressed.
+	logger.Info("test")
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Second * 2)
+		logger.Info("test")
+	}
+	assert.Equal(t, 1, countLines())
+
+	// The spike disables the suppression during the cooldown.
+	now = now.Add(time.Second * 2)
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Millisecond * 100)
+		logger.Info("test")
+	}
+	assert.Equal(t, 3, countLines())
+
+	// The suppression is enabled again after the cooldown.
+	now = now.Add(time.Minute)
+	logger.Info("test")
+	assert.Equal(t, 0, countLines())
+}
+
+func TestClockSteps(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+	// The wall clock without the monotonic clock reading.
+	now := time.Now().Round(0)
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	logger.Info("test")
+	assert.NotEmpty(t, b.String())
+
+	// The backward step does not extend the expiration.
+	now = now.Add(-time.Hour)
+	b.Reset()
+	logger.Info("test")
+	assert.Empty(t, b.String())
+	now = now.Add(time.Minute * 2)
+	b.Reset()
+	logger.Info("test")
+	assert.NotEmpty(t, b.String())
+
+	// The history is kept as long as the clock advances less than the retention period.
+	now = now.Add(time.Second * 30)
+	b.Reset()
+	logger.Info("test")
+	assert.Empty(t, b.String())
+
+	// The forward step expires the history like the actual time passage.
+	now = now.Add(time.Hour)
+	b.Reset()
+	logger.Info("test")
+	assert.NotEmpty(t, b.String())
+}
+
+func TestAddWindowID(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			AddWindowID:            true,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+	windowID := func() any {
+		jsonLog := make(map[string]any)
+		err := json.Unmarshal(b.Bytes(), &jsonLog)
+		require.NoError(t, err)
+		b.Reset()
+		return jsonLog[WindowIDKey]
+	}
+
+	logger.Info("test")
+	assert.Equal(t, float64(1), windowID())
+	logger.Info("test")
+	assert.Empty(t, b.String())
+
+	// The record bypassing the deduplication is in the same window.
+	logger.Warn("test")
+	assert.Equal(t, float64(1), windowID())
+
+	now = now.Add(time.Minute * 2)
+	logger.Info("test")
+	assert.Equal(t, float64(2), windowID())
+}
+
+func TestDisabledLevelDoesNotUpdateHistory(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(),
+		slog.NewJSONHandler(b, &slog.HandlerOptions{
+			Level: slog.LevelWarn,
+		}),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+
+	err := h.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "test", 0))
+	require.NoError(t, err)
+	assert.Empty(t, b.String())
+	assert.Empty(t, h.history)
+	assert.Zero(t, h.Stats().Emitted)
+}
+
+type retainingHandler struct {
+	slog.Handler
+	records []slog.Record
+}
+
+func (h *retainingHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.records = append(h.records, r)
+	return nil
+}
+
+func TestHandleDoesNotModifyCallerRecord(t *testing.T) {
+	rh := &retainingHandler{Handler: slog.NewJSONHandler(io.Discard, nil)}
+	h := NewDedupHandler(context.Background(), rh,
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			AddSequence:            true,
+		})
+
+	// Enough attrs to be stored out of the inline array of the Record.
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, "test", 0)
+	for i := 0; i < 8; i++ {
+		r.AddAttrs(slog.Int(fmt.Sprintf("key%d", i), i))
+	}
+	require.NoError(t, h.Handle(context.Background(), r))
+	assert.Equal(t, 8, r.NumAttrs())
+
+	// The caller reuses the record.
+	r.AddAttrs(slog.String("caller", "value"))
+
+	require.Len(t, rh.records, 1)
+	keys := []string{}
+	rh.records[0].Attrs(func(a slog.Attr) bool {
+		keys = append(keys, a.Key)
+		return true
+	})
+	assert.NotContains(t, keys, "caller")
+	assert.Contains(t, keys, SequenceKey)
+
+	keys = []string{}
+	r.Attrs(func(a slog.Attr) bool {
+		keys = append(keys, a.Key)
+		return true
+	})
+	assert.Contains(t, keys, "caller")
+	assert.NotContains(t, keys, SequenceKey)
+	assert.NotContains(t, keys, "!BUG")
+}
+
+type countingHandler struct {
+	slog.Handler
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newCountingHandler() *countingHandler {
+	return &countingHandler{
+		Handler: slog.NewJSONHandler(io.Discard, nil),
+		counts:  make(map[string]int),
+	}
+}
+
+func (h *countingHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[r.Message] += 1
+	return nil
+}
+
+func (h *countingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *countingHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+func TestDerivedHandlersConcurrently(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := newCountingHandler()
+	h := NewDedupHandler(ctx, ch, &HandlerOptions{
+		HistoryRetentionPeriod: time.Minute,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+		CleanupInterval:        time.Millisecond,
+	})
+	before := runtime.NumGoroutine()
+
+	const goroutines = 50
+	const messages = 10
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var derived slog.Handler = h.WithAttrs([]slog.Attr{slog.Int("worker", i)})
+			if i%2 == 0 {
+				derived = derived.WithGroup("group")
+			}
+			logger := slog.New(derived)
+			for j := 0; j < 100; j++ {
+				logger.Info(fmt.Sprintf("msg-%d", j%messages))
+				if j%10 == 0 {
+					logger = logger.With("request", j)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The derived handlers share the history and the stats.
+	require.Len(t, ch.counts, messages)
+	for msg, count := range ch.counts {
+		assert.Equal(t, 1, count, msg)
+	}
+	stats := h.Stats()
+	assert.Equal(t, int64(messages), stats.Emitted)
+	assert.Equal(t, int64(goroutines*100-messages), stats.Suppressed)
+	assert.Equal(t, stats, h.WithAttrs(nil).(*DedupHandler).Stats())
+	// Derived handlers do not start cleanup goroutines.
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+func TestLoggersSharingHandler(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod: time.Minute,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+	})
+	loggers := []*slog.Logger{slog.New(h), slog.New(h)}
+
+	const goroutines = 10
+	const messages = 20
+	run := func(f func(i int)) {
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				f(i)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	// The loggers share the history and the stats.
+	run(func(i int) {
+		logger := loggers[i%len(loggers)]
+		for j := 0; j < 100; j++ {
+			logger.Info(fmt.Sprintf("msg-%d", j%messages))
+			if j%10 == 0 {
+				_ = h.Stats()
+				h.SetMaxHistoryCount(DefaultMaxHistoryCount)
+			}
+		}
+	})
+	require.Len(t, ch.counts, messages)
+	for msg, count := range ch.counts {
+		assert.Equal(t, 1, count, msg)
+	}
+	stats := h.Stats()
+	assert.Equal(t, int64(messages), stats.Emitted)
+	assert.Equal(t, int64(goroutines*100-messages), stats.Suppressed)
+
+	// The dynamic methods are safe while logging.
+	run(func(i int) {
+		logger := loggers[i%len(loggers)]
+		for j := 0; j < 100; j++ {
+			logger.Info(fmt.Sprintf("msg-%d", j%messages))
+			switch j % 25 {
+			case 0:
+				h.Reset()
+			case 1:
+				h.SetMaxHistoryCount(messages / 2)
+			case 2:
+				_ = logger.With("worker", i).Handler()
+			}
+		}
+	})
+	assert.LessOrEqual(t, historyLen(h), messages/2)
+	stats = h.Stats()
+	assert.Equal(t, int64(goroutines*100*2), stats.Emitted+stats.Suppressed)
+
+	run(func(i int) {
+		if i == 0 {
+			require.NoError(t, h.Close())
+		}
+		loggers[i%len(loggers)].Info("after close")
+	})
+	for _, logger := range loggers {
+		assert.ErrorIs(t, logger.Handler().Handle(context.Background(),
+			slog.NewRecord(time.Now(), slog.LevelInfo, "closed", 0)), ErrHandlerClosed)
+	}
+	assert.Zero(t, ch.counts["closed"])
+}
+
+func TestDowngradeInsteadOfDrop(t *testing.T) {
+	b := new(bytes.Buffer)
+	debug := slog.LevelDebug
+	logger := slog.New(NewDedupHandler(context.Background(),
+		slog.NewJSONHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			DowngradeInsteadOfDrop: &debug,
+		}))
+
+	logger.Info("test")
+	logger.Info("test")
+
+	dec := json.NewDecoder(b)
+	levels := []string{}
+	for {
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			break
+		}
+		assert.Equal(t, "test", m["msg"])
+		levels = append(levels, m["level"].(string))
+	}
+	assert.Equal(t, []string{"INFO", "DEBUG"}, levels)
+}
+
+func TestDowngradeInsteadOfDropBelowThreshold(t *testing.T) {
+	b := new(bytes.Buffer)
+	debug := slog.LevelDebug
+	logger := slog.New(NewDedupHandler(context.Background(),
+		slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			DowngradeInsteadOfDrop: &debug,
+		}))
+
+	logger.Info("test")
+	logger.Info("test")
+
+	assert.Equal(t, 1, strings.Count(b.String(), "\n"))
+}
+
+func TestDebugSuppressed(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(),
+		slog.NewJSONHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			DebugSuppressed:        true,
+		}))
+
+	logger.Info("test", "n", 1)
+	logger.Info("test", "n", 2)
+
+	dec := json.NewDecoder(b)
+	var records []map[string]any
+	for {
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			break
+		}
+		records = append(records, m)
+	}
+	require.Len(t, records, 2)
+	assert.Equal(t, "INFO", records[0]["level"])
+	assert.NotContains(t, records[0], SuppressedKey)
+	assert.Equal(t, "DEBUG", records[1]["level"])
+	assert.Equal(t, "test", records[1]["msg"])
+	assert.Equal(t, float64(2), records[1]["n"])
+	assert.Equal(t, true, records[1][SuppressedKey])
+
+	// The suppressed records are dropped at the INFO level as usual.
+	b.Reset()
+	logger = slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			DebugSuppressed:        true,
+		}))
+	logger.Info("test")
+	logger.Info("test")
+	assert.Equal(t, 1, strings.Count(b.String(), "\n"))
+}
+
+func TestMaxKeyLifetime(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Hour,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			MaxKeyLifetime:         time.Minute,
+			AddSequence:            true,
+		})
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	// The key recurs every 10 seconds, and would be suppressed for an hour
+	// without MaxKeyLifetime.
+	for i := 0; i < 13; i++ {
+		logger.Info("test")
+		clock.Advance(10 * time.Second)
+	}
+
+	seqs := []float64{}
+	for _, line := range bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n")) {
+		jsonLog := make(map[string]any)
+		require.NoError(t, json.Unmarshal(line, &jsonLog))
+		seqs = append(seqs, jsonLog[SequenceKey].(float64))
+	}
+	// Emitted at 0s, 60s and 120s, each time as a new key.
+	assert.Equal(t, []float64{1, 1, 1}, seqs)
+}
+
+func TestClose(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+	derived := h.WithAttrs([]slog.Attr{slog.String("key", "value")})
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, "test", 0)
+	require.NoError(t, h.Handle(context.Background(), r))
+
+	require.NoError(t, h.Close())
+	require.NoError(t, h.Close())
+
+	assert.ErrorIs(t, h.Handle(context.Background(), r), ErrHandlerClosed)
+	assert.ErrorIs(t, derived.Handle(context.Background(), r), ErrHandlerClosed)
+	assert.Error(t, h.lifetimeCtx.Err())
+	assert.Equal(t, 1, strings.Count(b.String(), "\n"))
+}
+
+func TestCloseDerived(t *testing.T) {
+	for _, unsynchronized := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unsynchronized=%t", unsynchronized), func(t *testing.T) {
+			ch := newCountingHandler()
+			h := NewDedupHandler(context.Background(), ch,
+				&HandlerOptions{
+					HistoryRetentionPeriod: time.Hour,
+					MaxHistoryCount:        DefaultMaxHistoryCount,
+					CleanupInterval:        time.Hour,
+					EmitSummary:            true,
+					CountInMessage:         true,
+					FlushOnShutdown:        true,
+					Unsynchronized:         unsynchronized,
+				})
+			derived := h.WithAttrs([]slog.Attr{slog.String("key", "value")})
+			logger := slog.New(h)
+			for i := 0; i < 3; i++ {
+				logger.Info("foo")
+			}
+
+			// Closing a derived handler stops the cleanup of the root and
+			// drains its pending summaries.
+			require.NoError(t, derived.(*DedupHandler).Close())
+			assert.Error(t, h.lifetimeCtx.Err())
+			if !unsynchronized {
+				select {
+				case <-h.cleanupDone:
+				case <-time.After(time.Second):
+					t.Fatal("the cleanup of the root did not stop")
+				}
+			}
+			ch.mu.Lock()
+			defer ch.mu.Unlock()
+			assert.Equal(t, 1, ch.counts["foo (x2)"])
+			assert.ErrorIs(t, h.Handle(context.Background(),
+				slog.NewRecord(time.Now(), slog.LevelInfo, "bar", 0)), ErrHandlerClosed)
+		})
+	}
+}
+
+func TestHandleWrappedError(t *testing.T) {
+	errWrapped := errors.New("wrapped failure")
+	h := NewDedupHandler(context.Background(), errHandler{slog.NewJSONHandler(io.Discard, nil), errWrapped},
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+
+	err := h.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "test", 0))
+	assert.ErrorIs(t, err, errWrapped)
+	assert.NotErrorIs(t, err, ErrEmitTimeout)
+	assert.NotErrorIs(t, err, ErrHandlerClosed)
+}
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestAddedAttrOrder(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(),
+		slog.NewJSONHandler(b, &slog.HandlerOptions{
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.TimeKey && len(groups) == 0 {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			AddSequence:            true,
+			AddWindowID:            true,
+			AddKeyHashAttr:         true,
+			EmitSummary:            true,
+			SummarizeAttr:          "user",
+			Name:                   "golden",
+		})
+	logger := slog.New(h)
+
+	logger.Info("test", "user", "alice")
+	logger.Info("test", "user", "bob")
+	logger.Info("test", "user", "carol")
+	h.Flush("test")
+	logger.Info("test", "user", "alice")
+
+	golden := filepath.Join("testdata", "attr_order.golden")
+	if *update {
+		require.NoError(t, os.WriteFile(golden, b.Bytes(), 0o644))
+	}
+	want, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), b.String())
+}
+
+func TestStripTokens(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			StripTrailingToken:     true,
+		}))
+
+	for i := 0; i < 5; i++ {
+		logger.Info(fmt.Sprintf("task done #%d", 1230+i))
+	}
+
+	assert.Equal(t, 1, strings.Count(b.String(), "\n"))
+	assert.Contains(t, b.String(), "task done #1230")
+
+	testCases := []struct {
+		name     string
+		leading  bool
+		trailing bool
+		msg      string
+		want     string
+	}{
+		{name: "trailing", trailing: true, msg: "task done #1", want: "task done"},
+		{name: "leading", leading: true, msg: "[42] task  done", want: "task  done"},
+		{name: "both", leading: true, trailing: true, msg: " 1 task done 2 ", want: "task done"},
+		{name: "single token", leading: true, trailing: true, msg: "done", want: "done"},
+		{name: "disabled", msg: "task done #1", want: "task done #1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+				&HandlerOptions{
+					StripLeadingToken:  tc.leading,
+					StripTrailingToken: tc.trailing,
+				})
+			assert.Equal(t, tc.want, h.key(slog.NewRecord(time.Now(), slog.LevelInfo, tc.msg, 0)))
+		})
+	}
+}
+
+func TestSetHandler(t *testing.T) {
+	oldHandler := newCountingHandler()
+	newHandler := newCountingHandler()
+	h := NewDedupHandler(context.Background(), oldHandler,
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+	logger := slog.New(h)
+	logger.Info("before")
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+					logger.Info(fmt.Sprintf("concurrent-%d-%d", i, j%10))
+				}
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	h.SetHandler(newHandler)
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	// The history is kept.
+	logger.Info("before")
+	logger.Info("after")
+
+	oldHandler.mu.Lock()
+	defer oldHandler.mu.Unlock()
+	newHandler.mu.Lock()
+	defer newHandler.mu.Unlock()
+	assert.Equal(t, 1, oldHandler.counts["before"])
+	assert.NotContains(t, newHandler.counts, "before")
+	assert.NotContains(t, oldHandler.counts, "after")
+	assert.Equal(t, 1, newHandler.counts["after"])
+	// Each message is emitted once in total.
+	for msg, count := range newHandler.counts {
+		assert.Equal(t, 1, count+oldHandler.counts[msg], msg)
+	}
+}
+
+func TestSetHandlerDerived(t *testing.T) {
+	oldBuf := new(bytes.Buffer)
+	newBuf := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(oldBuf, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CacheEnabledDecisions:  true,
+		})
+	defer h.Close()
+	derived := slog.New(h).With("k", "v").WithGroup("g")
+	derived.Info("before", "a", 1)
+
+	// SetHandler on the derived handler replaces the handler of all, and
+	// the derived handler wraps the new one with its attributes and groups.
+	derived.Handler().(*DedupHandler).SetHandler(slog.NewJSONHandler(newBuf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	derived.Info("dropped", "a", 1)
+	derived.Warn("after", "a", 1)
+	slog.New(h).Warn("root")
+
+	assert.Contains(t, oldBuf.String(), `"msg":"before","k":"v","g":{"a":1}`)
+	assert.NotContains(t, oldBuf.String(), "after")
+	assert.NotContains(t, newBuf.String(), "dropped")
+	assert.Contains(t, newBuf.String(), `"msg":"after","k":"v","g":{"a":1}`)
+	assert.Contains(t, newBuf.String(), `"msg":"root"}`)
+}
+
+func TestHighWaterMark(t *testing.T) {
+	for _, hwm := range []float64{0, 0.5} {
+		t.Run(fmt.Sprintf("HighWaterMark=%v", hwm), func(t *testing.T) {
+			h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+				&HandlerOptions{
+					HistoryRetentionPeriod: time.Second,
+					MaxHistoryCount:        100,
+					CleanupInterval:        time.Second,
+					HighWaterMark:          hwm,
+				})
+			// The background cleanup cannot keep up.
+			h.PauseCleanup()
+			clock := newFakeClock()
+			setClock(h, clock)
+			logger := slog.New(h)
+
+			maxLen := 0
+			for i := 0; i < 1000; i++ {
+				logger.Info(fmt.Sprintf("test%d", i))
+				clock.Advance(100 * time.Millisecond)
+				maxLen = max(maxLen, historyLen(h))
+			}
+			if hwm == 0 {
+				assert.Equal(t, 100, maxLen)
+			} else {
+				assert.LessOrEqual(t, maxLen, 50)
+			}
+		})
+	}
+}
+
+func TestHighWaterMarkSweepInterval(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: 100 * time.Millisecond,
+			MaxHistoryCount:        100,
+			CleanupInterval:        10 * time.Second,
+			HighWaterMark:          0.5,
+		})
+	h.PauseCleanup()
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+	logN := func(prefix string, n int) {
+		for i := 0; i < n; i++ {
+			logger.Info(fmt.Sprintf("%s%d", prefix, i))
+		}
+	}
+
+	logN("a", 50)
+	clock.Advance(200 * time.Millisecond)
+	logN("b", 1)
+	assert.Equal(t, 1, historyLen(h))
+
+	// The expired keys are kept until a second has passed since the last
+	// inline removal.
+	logN("c", 49)
+	clock.Advance(200 * time.Millisecond)
+	logN("d", 1)
+	assert.Equal(t, 51, historyLen(h))
+	clock.Advance(time.Second)
+	logN("e", 1)
+	assert.Equal(t, 1, historyLen(h))
+}
+
+func TestDumpHistory(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+	logger := slog.New(h)
+	logger.Info("foo")
+	logger.Info("bar")
+	logger.Info("foo")
+
+	assert.Equal(t, []KeyCount{{Key: "bar", Count: 0}, {Key: "foo", Count: 1}}, h.DumpHistory())
+}
+
+func TestKeySalt(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			KeySalt:                []byte("secret"),
+		})
+	logger := slog.New(h)
+	logger.Info("password of alice is wrong")
+	logger.Info("password of alice is wrong")
+	logger.Info("password of bob is wrong")
+
+	assert.Equal(t, 2, strings.Count(b.String(), "\n"))
+	dump := h.DumpHistory()
+	require.Len(t, dump, 2)
+	for _, kc := range dump {
+		assert.Regexp(t, "^[0-9a-f]{64}$", kc.Key)
+		assert.NotContains(t, kc.Key, "alice")
+	}
+
+	// The same salt gives the same hashes.
+	other := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{KeySalt: []byte("secret")})
+	key := other.key(slog.NewRecord(time.Now(), slog.LevelInfo, "password of alice is wrong", 0))
+	assert.Contains(t, dump, KeyCount{Key: key, Count: 1})
+}
+
+func TestEventAttr(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			EventAttr:              "event",
+			EventKeyAttrs:          []string{"region"},
+		}))
+	countLines := func() int {
+		n := strings.Count(b.String(), "\n")
+		b.Reset()
+		return n
+	}
+
+	logger.Info("alice logged in", "event", "user.login", "region", "eu")
+	logger.Info("bob logged in", "event", "user.login", "region", "eu")
+	logger.Info("carol logged in from somewhere", "event", "user.login", "region", "eu")
+	assert.Equal(t, 1, countLines())
+
+	// A different value of EventKeyAttrs is a different key.
+	logger.Info("dave logged in", "event", "user.login", "region", "us")
+	logger.Info("erin logged in", "event", "user.login")
+	assert.Equal(t, 2, countLines())
+
+	// The records without EventAttr are keyed by the message.
+	logger.Info("user.login")
+	logger.Info("alice logged in")
+	logger.Info("alice logged in")
+	assert.Equal(t, 2, countLines())
+}
+
+func TestOnExpire(t *testing.T) {
+	type expiry struct {
+		key   string
+		count int
+	}
+	var expiries []expiry
+	var h *DedupHandler
+	h = NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CleanupInterval:        time.Hour,
+			OnExpire: func(key string, suppressedCount int) {
+				expiries = append(expiries, expiry{key: key, count: suppressedCount})
+				// The callback may log through the handler.
+				slog.New(h).Info("expired " + key)
+			},
+		})
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	logger.Info("test")
+	logger.Info("test")
+	logger.Info("test")
+	clock.Advance(time.Minute * 2)
+	h.removeExpiredHistory()
+
+	assert.Equal(t, []expiry{{key: "test", count: 2}}, expiries)
+	assert.Equal(t, 1, historyLen(h))
+}
+
+func TestHandleZeroRecord(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			AddSequence:            true,
+			KeyBySource:            true,
+			KeyByMessageAndAttrs:   true,
+		})
+
+	emitted, reason, err := h.HandleReport(context.Background(), slog.Record{})
+	require.NoError(t, err)
+	assert.True(t, emitted)
+	assert.Equal(t, ReasonEmitted, reason)
+	emitted, reason, err = h.HandleReport(context.Background(), slog.Record{})
+	require.NoError(t, err)
+	assert.False(t, emitted)
+	assert.Equal(t, ReasonSuppressedDuplicate, reason)
+
+	jsonLog := make(map[string]any)
+	require.NoError(t, json.Unmarshal(b.Bytes(), &jsonLog))
+	assert.Equal(t, "", jsonLog["msg"])
+	assert.Equal(t, "INFO", jsonLog["level"])
+	assert.NotContains(t, jsonLog, slog.TimeKey)
+}
+
+func TestLastEmitted(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	emittedAt := clock.Now()
+	logger.Info("test")
+	clock.Advance(time.Second)
+	logger.Info("test")
+	clock.Advance(time.Second)
+	logger.Info("test")
+
+	last, ok := h.LastEmitted("test")
+	assert.True(t, ok)
+	assert.Equal(t, emittedAt, last)
+
+	h.Preload("preloaded")
+	_, ok = h.LastEmitted("preloaded")
+	assert.False(t, ok)
+	_, ok = h.LastEmitted("unknown")
+	assert.False(t, ok)
+}
+
+func TestSampleEvery(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			SampleEvery:            3,
+		})
+
+	reasons := []Reason{}
+	for i := 0; i < 7; i++ {
+		r := slog.NewRecord(time.Now(), slog.LevelInfo, "test", 0)
+		r.AddAttrs(slog.Int("occurrence", i))
+		_, reason, err := h.HandleReport(context.Background(), r)
+		require.NoError(t, err)
+		reasons = append(reasons, reason)
+	}
+	assert.Equal(t, []Reason{
+		ReasonEmitted,
+		ReasonSuppressedDuplicate, ReasonSuppressedDuplicate, ReasonSampled,
+		ReasonSuppressedDuplicate, ReasonSuppressedDuplicate, ReasonSampled,
+	}, reasons)
+
+	lines := bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n"))
+	require.Len(t, lines, 3)
+	for i, want := range []float64{0, 3, 6} {
+		jsonLog := make(map[string]any)
+		require.NoError(t, json.Unmarshal(lines[i], &jsonLog))
+		assert.Equal(t, want, jsonLog["occurrence"])
+		if i > 0 {
+			assert.Equal(t, float64(3), jsonLog[SampledOfKey])
+		} else {
+			assert.NotContains(t, jsonLog, SampledOfKey)
+		}
+	}
+	assert.Equal(t, int64(3), h.Stats().Emitted)
+	assert.Equal(t, int64(4), h.Stats().Suppressed)
+}
+
+func TestFirstEmitCooldown(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod: time.Minute,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+		CleanupInterval:        time.Hour,
+		FirstEmitCooldown:      100 * time.Millisecond,
+	})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	// The tight burst is suppressed during the cooldown.
+	for i := 0; i < 10; i++ {
+		logger.Info("retrying")
+		clock.Advance(5 * time.Millisecond)
+	}
+	assert.Equal(t, 1, ch.counts["retrying"])
+
+	// The first one after the cooldown is emitted and starts the full
+	// retention.
+	clock.Advance(100 * time.Millisecond)
+	logger.Info("retrying")
+	assert.Equal(t, 2, ch.counts["retrying"])
+	for i := 0; i < 10; i++ {
+		clock.Advance(5 * time.Second)
+		logger.Info("retrying")
+	}
+	assert.Equal(t, 2, ch.counts["retrying"])
+
+	// The cooldown applies again after the history expires.
+	clock.Advance(2 * time.Minute)
+	logger.Info("retrying")
+	logger.Info("retrying")
+	assert.Equal(t, 3, ch.counts["retrying"])
+	clock.Advance(200 * time.Millisecond)
+	logger.Info("retrying")
+	assert.Equal(t, 4, ch.counts["retrying"])
+}
+
+func TestKeyFor(t *testing.T) {
+	ctx := context.Background()
+	newRecord := func(msg string, args ...any) slog.Record {
+		r := slog.NewRecord(time.Now(), slog.LevelInfo, msg, 0)
+		r.Add(args...)
+		return r
+	}
+
+	h := NewDedupHandler(ctx, slog.Default().Handler(), &HandlerOptions{
+		HistoryRetentionPeriod: time.Minute,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+		Normalizer:             NormalizeNumbers,
+	})
+	defer h.Close()
+	assert.Equal(t, "retry <num>", h.KeyFor(ctx, newRecord("retry 3")))
+	assert.Equal(t, h.KeyFor(ctx, newRecord("retry 3")), h.KeyFor(ctx, newRecord("retry 12")))
+	assert.Zero(t, historyLen(h))
+
+	h = NewDedupHandler(ctx, slog.Default().Handler(), &HandlerOptions{
+		HistoryRetentionPeriod: time.Minute,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+		EventAttr:              "event",
+		EventKeyAttrs:          []string{"user"},
+	})
+	defer h.Close()
+	login := h.KeyFor(ctx, newRecord("alice logged in", "event", "login", "user", "alice", "ip", "10.0.0.1"))
+	assert.Equal(t, login, h.KeyFor(ctx, newRecord("alice signed in", "event", "login", "user", "alice", "ip", "10.0.0.2")))
+	assert.NotEqual(t, login, h.KeyFor(ctx, newRecord("bob logged in", "event", "login", "user", "bob")))
+	assert.Equal(t, "no event", h.KeyFor(ctx, newRecord("no event", "user", "alice")))
+}
+
+func TestAlwaysEmitAtOrAbove(t *testing.T) {
+	ch := newCountingHandler()
+	floor := slog.LevelError
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod: time.Minute,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+		DedupLogLevel:          slog.LevelError,
+		DedupPredicate:         func(context.Context, slog.Record) bool { return true },
+		GlobalMaxEmitRate:      1,
+		AlwaysEmitAtOrAbove:    &floor,
+	})
+	defer h.Close()
+	logger := slog.New(h)
+
+	for i := 0; i < 5; i++ {
+		logger.Error("disk failure")
+	}
+	assert.Equal(t, 5, ch.counts["disk failure"])
+	assert.Zero(t, historyLen(h))
+
+	// The records below the floor are deduplicated as usual.
+	logger.Warn("disk slow")
+	logger.Warn("disk slow")
+	assert.Equal(t, 1, ch.counts["disk slow"])
+}
+
+func TestEvictionPolicyRejectNew(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod: time.Minute,
+		MaxHistoryCount:        2,
+		CleanupInterval:        time.Minute * 10,
+		EvictionPolicy:         EvictionPolicyRejectNew,
+	})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	logger.Info("chatty 1")
+	logger.Info("chatty 2")
+	for i := 0; i < 3; i++ {
+		logger.Info("new")
+		logger.Info("chatty 1")
+		logger.Info("chatty 2")
+	}
+	assert.Equal(t, 3, ch.counts["new"])
+	assert.Equal(t, 1, ch.counts["chatty 1"])
+	assert.Equal(t, 1, ch.counts["chatty 2"])
+	assert.Equal(t, 2, historyLen(h))
+
+	// The expired keys make room for the new ones.
+	clock.Advance(time.Minute * 2)
+	logger.Info("new")
+	logger.Info("new")
+	assert.Equal(t, 4, ch.counts["new"])
+}
+
+func TestEvictionPolicyRejectNewSweepInterval(t *testing.T) {
+	ch := newCountingHandler()
+	var expired []string
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod: time.Second * 30,
+		MaxHistoryCount:        2,
+		CleanupInterval:        time.Minute * 10,
+		EvictionPolicy:         EvictionPolicyRejectNew,
+		OnExpire: func(key string, suppressedCount int) {
+			expired = append(expired, key)
+		},
+	})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	logger.Info("old 1")
+	logger.Info("old 2")
+	logger.Info("new 1")
+
+	// The expired keys are removed at most once per a tenth of
+	// CleanupInterval, so "new 2" is rejected although they expired.
+	clock.Advance(time.Second * 40)
+	logger.Info("new 2")
+	logger.Info("new 2")
+	assert.Equal(t, 2, ch.counts["new 2"])
+	assert.Empty(t, expired)
+
+	clock.Advance(time.Second * 20)
+	logger.Info("new 3")
+	logger.Info("new 3")
+	assert.Equal(t, 1, ch.counts["new 3"])
+	assert.ElementsMatch(t, []string{"old 1", "old 2"}, expired)
+	assert.Equal(t, 1, historyLen(h))
+}
+
+func TestAddKeyHashAttr(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			Normalizer:             NormalizeNumbers,
+			AddKeyHashAttr:         true,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	hashes := func() []string {
+		defer b.Reset()
+		dec := json.NewDecoder(b)
+		var hs []string
+		for {
+			var m map[string]any
+			if err := dec.Decode(&m); err != nil {
+				return hs
+			}
+			hs = append(hs, m[KeyHashKey].(string))
+		}
+	}
+
+	logger.Info("retry 1")
+	logger.Info("timeout")
+	now = now.Add(time.Minute * 2)
+	logger.Info("retry 2")
+	hs := hashes()
+	require.Len(t, hs, 3)
+	assert.Len(t, hs[0], 16)
+	// The hash reflects the normalized key.
+	assert.Equal(t, hs[0], hs[2])
+	assert.NotEqual(t, hs[0], hs[1])
+}
+
+func TestDedupLogLevelExclusive(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		exclusive bool
+		expected  int
+	}{
+		{name: "inclusive", exclusive: false, expected: 1},
+		{name: "exclusive", exclusive: true, expected: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ch := newCountingHandler()
+			logger := slog.New(NewDedupHandler(context.Background(), ch, &HandlerOptions{
+				HistoryRetentionPeriod: time.Minute,
+				MaxHistoryCount:        DefaultMaxHistoryCount,
+				DedupLogLevel:          slog.LevelWarn,
+				DedupLogLevelExclusive: tc.exclusive,
+			}))
+
+			logger.Warn("boundary")
+			logger.Warn("boundary")
+			assert.Equal(t, tc.expected, ch.counts["boundary"])
+
+			// The records below the level are deduplicated in both cases.
+			logger.Info("below")
+			logger.Info("below")
+			assert.Equal(t, 1, ch.counts["below"])
+		})
+	}
+}
+
+func TestCompactionThreshold(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        2000,
+			CompactionThreshold:    0.25,
+		})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	for i := 0; i < 1000; i++ {
+		logger.Info(fmt.Sprintf("spike %d", i))
+	}
+	assert.Equal(t, 1000, h.Stats().HistoryPeak)
+
+	clock.Advance(time.Second * 30)
+	for i := 0; i < 500; i++ {
+		logger.Info(fmt.Sprintf("steady %d", i))
+	}
+	clock.Advance(time.Second * 31)
+	h.removeExpiredHistory()
+	// 500 of the peak 1500 keys are left, which is above the threshold.
+	assert.Equal(t, 500, historyLen(h))
+	assert.Equal(t, 1500, h.Stats().HistoryPeak)
+	assert.Zero(t, h.Stats().Compactions)
+
+	for i := 0; i < 200; i++ {
+		logger.Info(fmt.Sprintf("late %d", i))
+	}
+	clock.Advance(time.Second * 30)
+	h.removeExpiredHistory()
+	assert.Equal(t, 200, historyLen(h))
+	assert.Equal(t, 200, h.Stats().HistoryPeak)
+	assert.EqualValues(t, 1, h.Stats().Compactions)
+
+	// The compacted history still deduplicates the records.
+	logger.Info("late 0")
+	assert.EqualValues(t, 1, h.Stats().Suppressed)
+
+	h.removeExpiredHistory()
+	assert.EqualValues(t, 1, h.Stats().Compactions)
+}
+
+func TestSetMaxHistoryCount(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch,
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        100000,
+			ProtectHottestOnEvict:  true,
+		})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	logger.Info("hot")
+	logger.Info("hot")
+	for i := 0; i < 99999; i++ {
+		logger.Info(fmt.Sprintf("test%d", i))
+	}
+	assert.Equal(t, 100000, historyLen(h))
+
+	// The newest keys and the hottest one are kept.
+	h.SetMaxHistoryCount(1000)
+	assert.Equal(t, 1000, historyLen(h))
+	logger.Info("hot")
+	logger.Info("test99000")
+	logger.Info("test98999")
+	assert.Equal(t, 1, ch.counts["hot"])
+	assert.Equal(t, 1, ch.counts["test99000"])
+	assert.Equal(t, 2, ch.counts["test98999"])
+}
+
+// Reference results on linux/amd64:
+//
+//	BenchmarkHandle/duplicate    ~250 ns/op    0 allocs/op
+//	BenchmarkHandle/unique       ~800 ns/op    0 allocs/op
+//	BenchmarkHandle/mixed        ~250 ns/op    0 allocs/op
+//	BenchmarkAtCapacity          ~21 us/op     1 allocs/op
+func BenchmarkHandle(b *testing.B) {
+	msgs := make([]string, 1<<16)
+	for i := range msgs {
+		msgs[i] = fmt.Sprintf("test%d", i)
+	}
+	testCases := []struct {
+		name string
+		msg  func(i int) string
+	}{
+		{name: "duplicate", msg: func(i int) string { return msgs[0] }},
+		{name: "unique", msg: func(i int) string { return msgs[i%len(msgs)] }},
+		{name: "mixed", msg: func(i int) string { return msgs[i%16] }},
+	}
+	for _, tc := range testCases {
+		b.Run(tc.name, func(b *testing.B) {
+			h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+				&HandlerOptions{
+					HistoryRetentionPeriod: time.Minute,
+					MaxHistoryCount:        len(msgs),
+				})
+			ctx := context.Background()
+			now := time.Now()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = h.Handle(ctx, slog.NewRecord(now, slog.LevelInfo, tc.msg(i), 0))
+			}
+		})
+	}
+}
+
+func BenchmarkAtCapacity(b *testing.B) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+	msgs := make([]string, DefaultMaxHistoryCount*2)
+	for i := range msgs {
+		msgs[i] = fmt.Sprintf("test%d", i)
+	}
+	ctx := context.Background()
+	now := time.Now()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = h.Handle(ctx, slog.NewRecord(now, slog.LevelInfo, msgs[i%len(msgs)], 0))
+	}
+}
+
+func BenchmarkHandleUnsynchronized(b *testing.B) {
+	for _, unsynchronized := range []bool{false, true} {
+		b.Run(fmt.Sprintf("unsynchronized=%t", unsynchronized), func(b *testing.B) {
+			logger := slog.New(NewDedupHandler(context.Background(),
+				slog.NewJSONHandler(io.Discard, nil),
+				&HandlerOptions{
+					HistoryRetentionPeriod: time.Minute,
+					MaxHistoryCount:        DefaultMaxHistoryCount,
+					Unsynchronized:         unsynchronized,
+				}))
+			msgs := make([]string, 64)
+			for i := range msgs {
+				msgs[i] = fmt.Sprintf("test%d", i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				logger.Info(msgs[i%len(msgs)])
+			}
+		})
+	}
+}
+
+// BenchmarkWithAttrs measures the per-request logger.With pattern.
+// Sharing the history with the derived handlers instead of creating one
+// for each of them reduced it from about 57 KB and 21 allocs to 510 B and
+// 10 allocs per op, most of which are in slog and the wrapped handler.
+func BenchmarkWithAttrs(b *testing.B) {
+	logger := slog.New(NewDedupHandler(context.Background(),
+		slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		}))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logger.With("request_id", i).Info("test")
+	}
+}
@@ -0,0 +1,23 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// Default returns a DedupHandler with the default options wrapping a text
+// handler writing to os.Stderr. It does not wrap slog.Default().Handler(),
+// because the built-in default handler deadlocks if it is installed back
+// with slog.SetDefault.
+func Default(ctx context.Context) *DedupHandler {
+	return NewDedupHandler(ctx, slog.NewTextHandler(os.Stderr, nil), nil)
+}
+
+// SetAsDefault installs a logger with the handler returned by Default by
+// slog.SetDefault, and returns the handler.
+func SetAsDefault(ctx context.Context) *DedupHandler {
+	h := Default(ctx)
+	slog.SetDefault(slog.New(h))
+	return h
+}
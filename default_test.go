@@ -0,0 +1,37 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetAsDefault(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	require.NoError(t, err)
+	defer f.Close()
+	stderr := os.Stderr
+	os.Stderr = f
+	defer func() { os.Stderr = stderr }()
+	defer slog.SetDefault(slog.Default())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := SetAsDefault(ctx)
+	assert.Same(t, h, slog.Default().Handler())
+
+	slog.Info("test")
+	slog.Info("test")
+	slog.Warn("test")
+
+	out, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(out), "level=INFO msg=test"))
+	assert.Equal(t, 1, strings.Count(string(out), "level=WARN msg=test"))
+}
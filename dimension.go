@@ -0,0 +1,45 @@
+package deduplog
+
+import (
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// dimensionKey returns the values of DimensionAttrs joined by "\x00".
+// The value of a dimension is looked up in r, and then in the attributes
+// given by WithAttrs. The missing ones are keyed as empty.
+func (h *DedupHandler) dimensionKey(r slog.Record) string {
+	var sb strings.Builder
+	for _, k := range h.opts.DimensionAttrs {
+		sb.WriteString("\x00")
+		if v, ok := findAttr(r, k); ok {
+			sb.WriteString(v.String())
+		} else {
+			sb.WriteString(h.dimensions[k])
+		}
+	}
+	return sb.String()
+}
+
+// withDimensions returns the dimension values of h updated by attrs.
+// The map of h is not modified because it is shared with h.
+func (h *DedupHandler) withDimensions(attrs []slog.Attr) map[string]string {
+	dims := h.dimensions
+	copied := false
+	for _, a := range attrs {
+		if !slices.Contains(h.opts.DimensionAttrs, a.Key) {
+			continue
+		}
+		if !copied {
+			dims = maps.Clone(h.dimensions)
+			if dims == nil {
+				dims = make(map[string]string)
+			}
+			copied = true
+		}
+		dims[a.Key] = a.Value.String()
+	}
+	return dims
+}
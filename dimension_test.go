@@ -0,0 +1,50 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDimensionAttrs(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod: time.Minute,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+		DimensionAttrs:         []string{"region", "shard"},
+	})
+	defer h.Close()
+	logger := slog.New(h)
+
+	// Each value of a dimension is deduplicated independently.
+	for i := 0; i < 2; i++ {
+		logger.Info("foo", "region", "us", "shard", 1)
+		logger.Info("foo", "region", "eu", "shard", 1)
+		logger.Info("foo", "region", "jp", "shard", 1)
+	}
+	assert.Equal(t, 3, ch.counts["foo"])
+	logger.Info("foo", "region", "us", "shard", 2)
+	assert.Equal(t, 4, ch.counts["foo"])
+
+	// The other attributes do not affect the key.
+	logger.Info("foo", "region", "us", "shard", 1, "user", "alice")
+	assert.Equal(t, 4, ch.counts["foo"])
+
+	// The missing dimensions are keyed as empty.
+	logger.Info("foo", "shard", 1)
+	logger.Info("foo", "region", "", "shard", 1)
+	assert.Equal(t, 5, ch.counts["foo"])
+
+	// The dimensions can be given by WithAttrs.
+	h2 := h.WithAttrs([]slog.Attr{slog.String("region", "us")}).(*DedupHandler)
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, "foo", 0)
+	r.AddAttrs(slog.Int("shard", 1))
+	r2 := slog.NewRecord(time.Now(), slog.LevelInfo, "foo", 0)
+	r2.AddAttrs(slog.String("region", "us"), slog.Int("shard", 1))
+	assert.Equal(t, h.KeyFor(context.Background(), r2), h2.KeyFor(context.Background(), r))
+	assert.NotEqual(t, h.KeyFor(context.Background(), r), h2.KeyFor(context.Background(), r))
+	assert.Nil(t, h.dimensions)
+}
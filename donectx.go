@@ -0,0 +1,32 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+)
+
+// DoneContextPolicy decides what NewDedupHandler does if its context is
+// already done, in which case the background cleanup would never run and
+// the expired history would be removed only when it is looked up or evicted.
+type DoneContextPolicy int
+
+const (
+	// DoneContextWarn emits a record with DoneContextWarningMessage at
+	// slog.LevelWarn to the wrapped handler.
+	DoneContextWarn DoneContextPolicy = iota
+	// DoneContextDetach runs the background cleanup with a context that is
+	// never canceled but has the values of the given one. Close still stops
+	// it.
+	DoneContextDetach
+)
+
+const DoneContextWarningMessage = "deduplog context is already done; the background cleanup is disabled"
+
+// warnDoneContext emits a record with DoneContextWarningMessage.
+func (h *DedupHandler) warnDoneContext(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	if !h.wrappedEnabled(ctx, slog.LevelWarn) {
+		return
+	}
+	_ = h.emit(ctx, h.newSyntheticRecord(h.now(), slog.LevelWarn, DoneContextWarningMessage))
+}
@@ -0,0 +1,61 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoneContextPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Run("warn", func(t *testing.T) {
+		ch := newCountingHandler()
+		h := NewDedupHandler(ctx, ch, &HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+		defer h.Close()
+		assert.Equal(t, 1, ch.counts[DoneContextWarningMessage])
+		assert.Eventually(t, func() bool {
+			return h.SelfCheck() != nil
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("detach", func(t *testing.T) {
+		ch := newCountingHandler()
+		h := NewDedupHandler(ctx, ch, &HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CleanupInterval:        time.Millisecond,
+			DoneContextPolicy:      DoneContextDetach,
+		})
+		defer h.Close()
+		clock := newFakeClock()
+		setClock(h, clock)
+		assert.Zero(t, ch.counts[DoneContextWarningMessage])
+		require.NoError(t, h.SelfCheck())
+
+		require.NoError(t, h.Handle(ctx, slog.NewRecord(time.Now(), slog.LevelInfo, "foo", 0)))
+		clock.Advance(2 * time.Minute)
+		assert.Eventually(t, func() bool {
+			return historyLen(h) == 0
+		}, time.Second, time.Millisecond)
+
+		// Close still stops the background cleanup.
+		require.NoError(t, h.Close())
+		assert.Eventually(t, func() bool {
+			select {
+			case <-h.cleanupDone:
+				return true
+			default:
+				return false
+			}
+		}, time.Second, time.Millisecond)
+	})
+}
@@ -0,0 +1,15 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+)
+
+// dryRunEmit emits the record r which would be suppressed, with
+// WouldSuppressKey, if DryRun is set.
+func (h *DedupHandler) dryRunEmit(ctx context.Context, r slog.Record) error {
+	if !h.opts.DryRun {
+		return nil
+	}
+	return h.emit(ctx, withAddedAttrs(r, slog.Bool(WouldSuppressKey, true)))
+}
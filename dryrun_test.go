@@ -0,0 +1,58 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRun(t *testing.T) {
+	b := new(bytes.Buffer)
+	overflow := newCountingHandler()
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			OverflowHandler:        overflow,
+			DryRun:                 true,
+		})
+	defer h.Close()
+	logger := slog.New(h)
+
+	logger.Info("foo")
+	logger.Info("foo")
+	logger.Info("bar")
+	logger.Info("foo")
+
+	dec := json.NewDecoder(b)
+	var records []map[string]any
+	for {
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			break
+		}
+		records = append(records, m)
+	}
+	require.Len(t, records, 4)
+	var wouldSuppress []any
+	for _, m := range records {
+		wouldSuppress = append(wouldSuppress, m[WouldSuppressKey])
+	}
+	assert.Equal(t, []any{nil, true, nil, true}, wouldSuppress)
+	assert.Empty(t, overflow.counts)
+
+	stats := h.Stats()
+	assert.Equal(t, int64(2), stats.Emitted)
+	assert.Equal(t, int64(2), stats.Suppressed)
+
+	ok, reason, err := h.HandleReport(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "foo", 0))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, ReasonSuppressedDuplicate, reason)
+}
@@ -0,0 +1,47 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// enabledCacheTTL is the time a cached result of Enabled of the wrapped
+// handler is used for.
+const enabledCacheTTL = 100 * time.Millisecond
+
+type enabledDecision struct {
+	enabled    bool
+	expireTime time.Time
+	// minLevel is the level of the wrapped handler when the decision was
+	// made, if it implements slog.Leveler.
+	minLevel slog.Level
+	// base is the base handler when the decision was made. The decision is
+	// discarded once SetHandler replaces it.
+	base *slog.Handler
+}
+
+// wrappedEnabled calls Enabled of the wrapped handler,
+// or returns the cached result if CacheEnabledDecisions is set.
+// If the wrapped handler implements slog.Leveler, the cached result is
+// not used once its level changes.
+func (h *DedupHandler) wrappedEnabled(ctx context.Context, level slog.Level) bool {
+	base := h.base.Load()
+	handler := h.wrapped()
+	if !h.opts.CacheEnabledDecisions {
+		return handler.Enabled(ctx, level)
+	}
+	var minLevel slog.Level
+	if l, ok := handler.(slog.Leveler); ok {
+		minLevel = l.Level()
+	}
+	now := h.now()
+	if v, ok := h.enabledCache.Load(level); ok {
+		if d := v.(enabledDecision); now.Before(d.expireTime) && d.minLevel == minLevel && d.base == base {
+			return d.enabled
+		}
+	}
+	enabled := handler.Enabled(ctx, level)
+	h.enabledCache.Store(level, enabledDecision{enabled: enabled, expireTime: now.Add(enabledCacheTTL), minLevel: minLevel, base: base})
+	return enabled
+}
@@ -0,0 +1,125 @@
+package deduplog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// enabledCountingHandler counts the calls to Enabled.
+type enabledCountingHandler struct {
+	slog.Handler
+	calls atomic.Int64
+}
+
+func (h *enabledCountingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	h.calls.Add(1)
+	return h.Handler.Enabled(ctx, level)
+}
+
+func TestCacheEnabledDecisions(t *testing.T) {
+	level := new(slog.LevelVar)
+	eh := &enabledCountingHandler{Handler: slog.NewJSONHandler(io.Discard, &slog.HandlerOptions{Level: level})}
+	h := NewDedupHandler(context.Background(), eh,
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CacheEnabledDecisions:  true,
+		})
+	clock := newFakeClock()
+	setClock(h, clock)
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, h.Enabled(context.Background(), slog.LevelInfo))
+	}
+	assert.Equal(t, int64(1), eh.calls.Load())
+
+	// The change of the level takes effect after the cache expires.
+	level.Set(slog.LevelWarn)
+	assert.True(t, h.Enabled(context.Background(), slog.LevelInfo))
+	clock.Advance(enabledCacheTTL)
+	assert.False(t, h.Enabled(context.Background(), slog.LevelInfo))
+	assert.Equal(t, int64(2), eh.calls.Load())
+}
+
+// levelerHandler is a countingHandler with the dynamic level
+// exposed by slog.Leveler.
+type levelerHandler struct {
+	*countingHandler
+	level *slog.LevelVar
+}
+
+func (h *levelerHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelerHandler) Level() slog.Level {
+	return h.level.Level()
+}
+
+func TestLevelerWrappedHandler(t *testing.T) {
+	for _, cache := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cache=%t", cache), func(t *testing.T) {
+			lh := &levelerHandler{countingHandler: newCountingHandler(), level: new(slog.LevelVar)}
+			h := NewDedupHandler(context.Background(), lh,
+				&HandlerOptions{
+					HistoryRetentionPeriod: time.Minute,
+					MaxHistoryCount:        DefaultMaxHistoryCount,
+					CacheEnabledDecisions:  cache,
+				})
+			defer h.Close()
+			clock := newFakeClock()
+			setClock(h, clock)
+			logger := slog.New(h)
+
+			lh.level.Set(slog.LevelWarn)
+			assert.False(t, h.Enabled(context.Background(), slog.LevelInfo))
+			logger.Info("foo")
+			// Handle checks the level as well.
+			assert.NoError(t, h.Handle(context.Background(), slog.NewRecord(clock.Now(), slog.LevelInfo, "foo", 0)))
+			assert.Equal(t, 0, lh.counts["foo"])
+			assert.Equal(t, 0, historyLen(h))
+			assert.EqualValues(t, 1, h.Stats().Filtered)
+
+			// The skipped record does not suppress the next one.
+			lh.level.Set(slog.LevelInfo)
+			assert.True(t, h.Enabled(context.Background(), slog.LevelInfo))
+			logger.Info("foo")
+			logger.Info("foo")
+			assert.Equal(t, 1, lh.counts["foo"])
+
+			lh.level.Set(slog.LevelWarn)
+			logger.Info("bar")
+			assert.Equal(t, 0, lh.counts["bar"])
+			lh.level.Set(slog.LevelDebug)
+			logger.Info("bar")
+			logger.Info("bar")
+			assert.Equal(t, 1, lh.counts["bar"])
+		})
+	}
+}
+
+func BenchmarkCacheEnabledDecisions(b *testing.B) {
+	for _, cache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%t", cache), func(b *testing.B) {
+			eh := &enabledCountingHandler{Handler: slog.NewJSONHandler(io.Discard, nil)}
+			logger := slog.New(NewDedupHandler(context.Background(), eh,
+				&HandlerOptions{
+					HistoryRetentionPeriod: time.Minute,
+					MaxHistoryCount:        DefaultMaxHistoryCount,
+					CacheEnabledDecisions:  cache,
+				}))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				logger.Info("test")
+			}
+			b.ReportMetric(float64(eh.calls.Load())/float64(b.N), "enabled-calls/op")
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package deduplog
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// expvarMetrics is the Metrics publishing the counters in an expvar.Map.
+type expvarMetrics struct {
+	suppressed  expvar.Int
+	emitted     expvar.Int
+	evicted     expvar.Int
+	historySize expvar.Int
+	// keys is replaced as a whole by SetKeySuppressed, so that the readers
+	// do not see it partially updated.
+	keys atomic.Pointer[expvar.Map]
+}
+
+func (m *expvarMetrics) IncSuppressed()       { m.suppressed.Add(1) }
+func (m *expvarMetrics) IncEmitted()          { m.emitted.Add(1) }
+func (m *expvarMetrics) IncEvicted()          { m.evicted.Add(1) }
+func (m *expvarMetrics) SetHistorySize(n int) { m.historySize.Set(int64(n)) }
+
+func (m *expvarMetrics) SetKeySuppressed(kcs []KeyCount) {
+	keys := new(expvar.Map)
+	for _, kc := range kcs {
+		v := new(expvar.Int)
+		v.Set(int64(kc.Count))
+		keys.Set(kc.Key, v)
+	}
+	m.keys.Store(keys)
+}
+
+func (m *expvarMetrics) keysJSON() any {
+	keys := m.keys.Load()
+	if keys == nil {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(keys.String())
+}
+
+// multiMetrics passes the counters to all of its Metrics.
+type multiMetrics []Metrics
+
+func (mm multiMetrics) IncSuppressed() {
+	for _, m := range mm {
+		m.IncSuppressed()
+	}
+}
+
+func (mm multiMetrics) IncEmitted() {
+	for _, m := range mm {
+		m.IncEmitted()
+	}
+}
+
+func (mm multiMetrics) IncEvicted() {
+	for _, m := range mm {
+		m.IncEvicted()
+	}
+}
+
+func (mm multiMetrics) SetHistorySize(n int) {
+	for _, m := range mm {
+		m.SetHistorySize(n)
+	}
+}
+
+func (mm multiMetrics) SetKeySuppressed(kcs []KeyCount) {
+	for _, m := range mm {
+		if km, ok := m.(KeyMetrics); ok {
+			km.SetKeySuppressed(kcs)
+		}
+	}
+}
+
+// publishMu serializes PublishExpvar.
+var publishMu sync.Mutex
+
+// PublishExpvar publishes the counters of h as an expvar.Map with name,
+// which is shown in /debug/vars. It has "suppressed", "emitted", "evicted"
+// and "history_size". They start from Stats at the call, except "evicted",
+// which starts from zero. If MetricsTopK is set, it also has "keys" with
+// the counts of KeyMetrics. They include the records of the handlers
+// derived by WithAttrs or WithGroup. It returns an error if name is already
+// published.
+func (h *DedupHandler) PublishExpvar(name string) error {
+	// expvar.Publish panics if name is published between the check and it.
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("expvar %q is already published", name)
+	}
+	m := &expvarMetrics{}
+	h.lock()
+	m.suppressed.Set(h.stats.Suppressed)
+	m.emitted.Set(h.stats.Emitted)
+	m.historySize.Set(int64(h.history.Len()))
+	perKey := h.opts.MetricsTopK > 0
+	if _, ok := h.metrics.(noopMetrics); ok {
+		h.metrics = m
+	} else {
+		h.metrics = multiMetrics{h.metrics, m}
+	}
+	h.unlock()
+
+	vars := new(expvar.Map)
+	vars.Set("suppressed", &m.suppressed)
+	vars.Set("emitted", &m.emitted)
+	vars.Set("evicted", &m.evicted)
+	vars.Set("history_size", &m.historySize)
+	if perKey {
+		vars.Set("keys", expvar.Func(m.keysJSON))
+	}
+	expvar.Publish(name, vars)
+	return nil
+}
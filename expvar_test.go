@@ -0,0 +1,105 @@
+package deduplog
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var expvarCount atomic.Int64
+
+// expvarName returns a name not published yet, since the names cannot be
+// unpublished, e.g. by go test -count.
+func expvarName(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", t.Name(), expvarCount.Add(1))
+}
+
+func TestPublishExpvar(t *testing.T) {
+	m := &fakeMetrics{}
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        2,
+			Metrics:                m,
+		})
+	defer h.Close()
+	logger := slog.New(h)
+	name := expvarName(t)
+
+	logger.Info("foo")
+	logger.Info("foo")
+	require.NoError(t, h.PublishExpvar(name))
+	assert.Error(t, h.PublishExpvar(name))
+	logger.Info("bar")
+	logger.Info("bar")
+	logger.Info("baz")
+
+	var vars map[string]int64
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get(name).String()), &vars))
+	stats := h.Stats()
+	assert.Equal(t, map[string]int64{
+		"suppressed":   stats.Suppressed,
+		"emitted":      stats.Emitted,
+		"evicted":      1,
+		"history_size": 2,
+	}, vars)
+	assert.Equal(t, int64(3), stats.Emitted)
+	assert.Equal(t, int64(2), stats.Suppressed)
+
+	// The Metrics given by the option still receives the counters.
+	assert.Equal(t, 3, m.emitted)
+}
+
+func TestPublishExpvarMetricsTopK(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			MetricsTopK:            1,
+		})
+	defer h.Close()
+	logger := slog.New(h)
+	name := expvarName(t)
+	require.NoError(t, h.PublishExpvar(name))
+	assert.JSONEq(t, `{"suppressed":0,"emitted":0,"evicted":0,"history_size":0,"keys":{}}`, expvar.Get(name).String())
+
+	for _, msg := range []string{"foo", "foo", "foo", "bar", "bar", "baz", "baz"} {
+		logger.Info(msg)
+	}
+	h.removeExpiredHistory()
+
+	var vars struct {
+		Keys map[string]int64 `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get(name).String()), &vars))
+	assert.Equal(t, map[string]int64{"foo": 2, MetricsOtherKey: 2}, vars.Keys)
+}
+
+func TestPublishExpvarConcurrently(t *testing.T) {
+	name := expvarName(t)
+	var wg sync.WaitGroup
+	var published atomic.Int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil), nil)
+			defer h.Close()
+			if h.PublishExpvar(name) == nil {
+				published.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), published.Load())
+}
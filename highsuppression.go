@@ -0,0 +1,60 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+)
+
+const (
+	// HighSuppressionWarningMessage is the message of the warning emitted
+	// when the ratio of the suppressed records exceeds
+	// HighSuppressionWarnRatio.
+	HighSuppressionWarningMessage = "deduplog is suppressing most records; check for a tight logging loop"
+	// SuppressionRatioKey is the key of the attribute holding the ratio
+	// of the suppressed records to the emitted ones in the warning.
+	SuppressionRatioKey = "dedup_suppression_ratio"
+	// TopKeysKey is the key of the attribute holding the most suppressed
+	// keys in the warning.
+	TopKeysKey = "dedup_top_keys"
+)
+
+// highSuppressionTopKeys is the number of the keys listed in the warning.
+const highSuppressionTopKeys = 3
+
+// warnHighSuppression emits a record with HighSuppressionWarningMessage if
+// the suppressed records outnumber the emitted ones by more than
+// HighSuppressionWarnRatio in the last HitRatioWindow. It is emitted at
+// most once per HitRatioWindow.
+func (h *DedupHandler) warnHighSuppression(ctx context.Context) error {
+	if h.opts.HighSuppressionWarnRatio <= 0 {
+		return nil
+	}
+	h.lock()
+	now := h.now()
+	if now.Before(h.nextSuppressionWarn) {
+		h.unlock()
+		return nil
+	}
+	checked, suppressed := h.hits.sum(now)
+	emitted := checked - suppressed
+	if float64(suppressed) <= h.opts.HighSuppressionWarnRatio*float64(emitted) {
+		h.unlock()
+		return nil
+	}
+	h.nextSuppressionWarn = now.Add(h.opts.HitRatioWindow)
+	h.unlock()
+
+	if !h.wrappedEnabled(ctx, slog.LevelWarn) {
+		return nil
+	}
+	r := h.newSyntheticRecord(now, slog.LevelWarn, HighSuppressionWarningMessage)
+	if emitted > 0 {
+		r.AddAttrs(slog.Float64(SuppressionRatioKey, float64(suppressed)/float64(emitted)))
+	}
+	var keys []string
+	for _, kc := range h.TopSuppressed(highSuppressionTopKeys) {
+		keys = append(keys, kc.Key)
+	}
+	r.AddAttrs(slog.Any(TopKeysKey, keys))
+	return h.emit(ctx, r)
+}
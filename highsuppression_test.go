@@ -0,0 +1,128 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHighSuppressionWarnRatio(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod:   time.Hour,
+		MaxHistoryCount:          DefaultMaxHistoryCount,
+		HitRatioWindow:           time.Minute,
+		HighSuppressionWarnRatio: 5,
+	})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	// A moderate ratio does not trigger the warning.
+	for i := 0; i < 5; i++ {
+		logger.Info(fmt.Sprintf("foo %d", i))
+		logger.Info(fmt.Sprintf("foo %d", i))
+	}
+	assert.Zero(t, ch.counts[HighSuppressionWarningMessage])
+
+	// 6 emitted and 30 suppressed are within the ratio.
+	for i := 0; i < 26; i++ {
+		logger.Info("loop")
+	}
+	assert.Equal(t, 0, ch.counts[HighSuppressionWarningMessage])
+	logger.Info("loop")
+	assert.Equal(t, 1, ch.counts[HighSuppressionWarningMessage])
+
+	// The warning is emitted once per HitRatioWindow.
+	for i := 0; i < 100; i++ {
+		logger.Info("loop")
+	}
+	assert.Equal(t, 1, ch.counts[HighSuppressionWarningMessage])
+	clock.Advance(time.Second * 59)
+	logger.Info("loop")
+	assert.Equal(t, 1, ch.counts[HighSuppressionWarningMessage])
+	clock.Advance(time.Second)
+	logger.Info("loop")
+	assert.Equal(t, 2, ch.counts[HighSuppressionWarningMessage])
+}
+
+func TestHighSuppressionWarningAttrs(t *testing.T) {
+	buf := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(buf, nil), &HandlerOptions{
+		HistoryRetentionPeriod:   time.Hour,
+		MaxHistoryCount:          DefaultMaxHistoryCount,
+		HighSuppressionWarnRatio: 1,
+	})
+	defer h.Close()
+	logger := slog.New(h)
+
+	logger.Info("foo")
+	logger.Info("bar")
+	logger.Info("bar")
+	logger.Info("foo")
+	logger.Info("bar")
+	assert.Contains(t, buf.String(), `"msg":"`+HighSuppressionWarningMessage+`","dedup_suppression_ratio":1.5,"dedup_top_keys":["bar","foo"]`)
+}
+
+func TestHighSuppressionWarningOnCleanup(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod:   time.Hour,
+		MaxHistoryCount:          DefaultMaxHistoryCount,
+		CleanupInterval:          10 * time.Millisecond,
+		HitRatioWindow:           time.Minute,
+		HighSuppressionWarnRatio: 5,
+	})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	for i := 0; i < 7; i++ {
+		logger.Info("loop")
+	}
+	clock.Advance(30 * time.Second)
+	for i := 0; i < 10; i++ {
+		logger.Info("loop")
+	}
+
+	// The ratio is still exceeded when the warning can be emitted again,
+	// and the cleanup emits it without waiting for the next duplicate.
+	clock.Advance(30 * time.Second)
+	require.Eventually(t, func() bool {
+		ch.mu.Lock()
+		defer ch.mu.Unlock()
+		return ch.counts[HighSuppressionWarningMessage] == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestHighSuppressionWarningError(t *testing.T) {
+	errWrapped := errors.New("wrapped failure")
+	overflow := newCountingHandler()
+	h := NewDedupHandler(context.Background(), errHandler{slog.NewJSONHandler(io.Discard, nil), errWrapped},
+		&HandlerOptions{
+			HistoryRetentionPeriod:   time.Hour,
+			MaxHistoryCount:          DefaultMaxHistoryCount,
+			HighSuppressionWarnRatio: 1,
+			OverflowHandler:          overflow,
+		})
+	defer h.Close()
+
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, "loop", 0)
+	assert.ErrorIs(t, h.Handle(context.Background(), r), errWrapped)
+	assert.NoError(t, h.Handle(context.Background(), r))
+
+	// The failure of the warning is returned, but the record still
+	// reaches OverflowHandler.
+	assert.ErrorIs(t, h.Handle(context.Background(), r), errWrapped)
+	assert.Equal(t, 2, overflow.counts["loop"])
+}
@@ -0,0 +1,31 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+)
+
+const (
+	LifecycleStartedMessage = "deduplog started"
+	LifecycleStoppedMessage = "deduplog stopped"
+)
+
+// logLifecycle emits a record with msg and the main options in effect
+// if LogLifecycle is set.
+func (h *DedupHandler) logLifecycle(ctx context.Context, msg string) {
+	if !h.opts.LogLifecycle || !h.wrappedEnabled(ctx, slog.LevelInfo) {
+		return
+	}
+	opts := h.Config()
+	r := h.newSyntheticRecord(h.now(), slog.LevelInfo, msg)
+	r.AddAttrs(slog.Group("options",
+		slog.Duration("history_retention_period", opts.HistoryRetentionPeriod),
+		slog.Int("max_history_count", opts.MaxHistoryCount),
+		slog.String("dedup_log_level", opts.DedupLogLevel.String()),
+		slog.Duration("cleanup_interval", opts.CleanupInterval),
+		slog.Bool("approximate_mode", opts.ApproximateMode),
+		slog.Bool("consecutive_only", opts.ConsecutiveOnly),
+		slog.Bool("emit_summary", opts.EmitSummary),
+	))
+	_ = h.emit(ctx, r)
+}
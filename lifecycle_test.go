@@ -0,0 +1,79 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogLifecycle(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        100,
+			LogLifecycle:           true,
+		})
+	logger := slog.New(h)
+	logger.Info("test")
+	logger.Info("test")
+	require.NoError(t, h.Close())
+	require.NoError(t, h.Close())
+
+	msgs := []string{}
+	dec := json.NewDecoder(b)
+	for dec.More() {
+		jsonLog := make(map[string]any)
+		require.NoError(t, dec.Decode(&jsonLog))
+		msgs = append(msgs, jsonLog["msg"].(string))
+		if jsonLog["msg"] == "test" {
+			continue
+		}
+		options := jsonLog["options"].(map[string]any)
+		assert.Equal(t, float64(time.Minute), options["history_retention_period"])
+		assert.Equal(t, float64(100), options["max_history_count"])
+		assert.Equal(t, "INFO", options["dedup_log_level"])
+	}
+	assert.Equal(t, []string{LifecycleStartedMessage, "test", LifecycleStoppedMessage}, msgs)
+}
+
+func TestLogLifecycleAfterFlush(t *testing.T) {
+	for _, unsynchronized := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unsynchronized=%t", unsynchronized), func(t *testing.T) {
+			gh := newGateHandler()
+			close(gh.unblock)
+			h := NewDedupHandler(context.Background(), gh,
+				&HandlerOptions{
+					HistoryRetentionPeriod: time.Minute,
+					MaxHistoryCount:        100,
+					CleanupInterval:        time.Hour,
+					LogLifecycle:           true,
+					EmitSummary:            true,
+					CountInMessage:         true,
+					FlushOnShutdown:        true,
+					Unsynchronized:         unsynchronized,
+				})
+			logger := slog.New(h)
+			logger.Info("test")
+			logger.Info("test")
+			require.NoError(t, h.Close())
+
+			// The stopped record follows the summaries of FlushOnShutdown.
+			assert.Equal(t, []string{LifecycleStartedMessage, "test", "test (x1)", LifecycleStoppedMessage}, gh.messages())
+		})
+	}
+}
+
+func TestLogLifecycleDisabled(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil), nil)
+	require.NoError(t, h.Close())
+	assert.Empty(t, b.String())
+}
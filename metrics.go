@@ -0,0 +1,63 @@
+package deduplog
+
+// Metrics receives the counters of a DedupHandler, so that they can be
+// exported to a metrics system such as Prometheus or OpenTelemetry without
+// the dependency of this package on it. The methods are called with the
+// lock of the handler held, so they must be fast and must not log to the
+// handler.
+type Metrics interface {
+	// IncSuppressed is called when a record is suppressed as a duplicate.
+	IncSuppressed()
+	// IncEmitted is called when a record is passed to the wrapped handler.
+	// The records generated by the handler are not included.
+	IncEmitted()
+	// IncEvicted is called when a key is evicted from the history to keep
+	// MaxHistoryCount.
+	IncEvicted()
+	// SetHistorySize is called with the number of the keys in the history
+	// when it changes. The handlers derived by WithAttrs or WithGroup
+	// share the history with their root, so the size covers all of them.
+	SetHistorySize(n int)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncSuppressed()     {}
+func (noopMetrics) IncEmitted()        {}
+func (noopMetrics) IncEvicted()        {}
+func (noopMetrics) SetHistorySize(int) {}
+
+// MetricsOtherKey is the key aggregating the keys other than the top
+// MetricsTopK ones in KeyMetrics.
+const MetricsOtherKey = "(other)"
+
+// KeyMetrics is implemented by the Metrics receiving the numbers of the
+// suppressed records per key. It is used only if MetricsTopK is set.
+type KeyMetrics interface {
+	// SetKeySuppressed is called after each cleanup of the history with
+	// the top MetricsTopK keys by the number of the suppressed records,
+	// followed by MetricsOtherKey with the sum of the rest. The counts
+	// replace the previous ones. It is called without the lock held.
+	SetKeySuppressed(kcs []KeyCount)
+}
+
+// reportKeyMetrics passes the per-key counts to Metrics
+// if it implements KeyMetrics.
+func (h *DedupHandler) reportKeyMetrics() {
+	if h.opts.MetricsTopK <= 0 {
+		return
+	}
+	h.lock()
+	km, ok := h.metrics.(KeyMetrics)
+	h.unlock()
+	if !ok {
+		return
+	}
+	kcs := h.suppressedKeyCounts()
+	k := min(len(kcs), h.opts.MetricsTopK)
+	other := KeyCount{Key: MetricsOtherKey}
+	for _, kc := range kcs[k:] {
+		other.Count += kc.Count
+	}
+	km.SetKeySuppressed(append(kcs[:k], other))
+}
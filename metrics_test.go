@@ -0,0 +1,139 @@
+package deduplog
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMetrics struct {
+	mu          sync.Mutex
+	suppressed  int
+	emitted     int
+	evicted     int
+	historySize int
+}
+
+func (m *fakeMetrics) IncSuppressed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.suppressed += 1
+}
+
+func (m *fakeMetrics) IncEmitted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.emitted += 1
+}
+
+func (m *fakeMetrics) IncEvicted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.evicted += 1
+}
+
+func (m *fakeMetrics) SetHistorySize(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.historySize = n
+}
+
+func TestMetrics(t *testing.T) {
+	m := &fakeMetrics{}
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        2,
+			Metrics:                m,
+		})
+	defer h.Close()
+	logger := slog.New(h)
+
+	logger.Info("foo")
+	logger.Info("foo")
+	logger.Info("bar")
+	assert.Equal(t, &fakeMetrics{suppressed: 1, emitted: 2, historySize: 2}, m)
+
+	logger.Info("baz")
+	assert.Equal(t, &fakeMetrics{suppressed: 1, emitted: 3, evicted: 1, historySize: 2}, m)
+
+	h.Flush("baz")
+	assert.Equal(t, 1, m.historySize)
+	h.Reset()
+	assert.Equal(t, 0, m.historySize)
+
+	stats := h.Stats()
+	assert.Equal(t, int64(m.emitted), stats.Emitted)
+	assert.Equal(t, int64(m.suppressed), stats.Suppressed)
+}
+
+func TestMetricsDerivedHandlers(t *testing.T) {
+	m := &fakeMetrics{}
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			Metrics:                m,
+		})
+	defer h.Close()
+	logger := slog.New(h)
+
+	logger.Info("foo")
+	logger.With("k", "v").Info("bar")
+	logger.WithGroup("g").Info("baz")
+	assert.Equal(t, 3, m.historySize)
+
+	// The derived handler reports the size of the shared history, not 0.
+	logger.With("k", "v").Info("foo")
+	assert.Equal(t, 3, m.historySize)
+}
+
+type fakeKeyMetrics struct {
+	fakeMetrics
+	kcs []KeyCount
+}
+
+func (m *fakeKeyMetrics) SetKeySuppressed(kcs []KeyCount) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kcs = kcs
+}
+
+func TestMetricsTopK(t *testing.T) {
+	m := &fakeKeyMetrics{}
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			Metrics:                m,
+			MetricsTopK:            2,
+		})
+	defer h.Close()
+	logger := slog.New(h)
+
+	for msg, n := range map[string]int{"foo": 5, "bar": 4, "baz": 3, "qux": 2, "quux": 1} {
+		for i := 0; i < n; i++ {
+			logger.Info(msg)
+		}
+	}
+	h.removeExpiredHistory()
+	assert.Equal(t, []KeyCount{
+		{Key: "foo", Count: 4},
+		{Key: "bar", Count: 3},
+		{Key: MetricsOtherKey, Count: 3},
+	}, m.kcs)
+
+	// The other bucket is reported even if it is empty.
+	h.Reset()
+	logger.Info("foo")
+	logger.Info("foo")
+	h.removeExpiredHistory()
+	assert.Equal(t, []KeyCount{
+		{Key: "foo", Count: 1},
+		{Key: MetricsOtherKey, Count: 0},
+	}, m.kcs)
+}
@@ -0,0 +1,136 @@
+package deduplog
+
+import (
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// Normalizer transforms a message into the form used for the deduplication.
+type Normalizer func(msg string) string
+
+var (
+	ipv4Regexp = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	// ipv6Regexp matches the candidates of IPv6 addresses, which are
+	// validated by netip.ParseAddr.
+	ipv6Regexp   = regexp.MustCompile(`(?i)[0-9a-f:.]*:[0-9a-f:.]*`)
+	uuidRegexp   = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+	hexRegexp    = regexp.MustCompile(`(?i)\b0x[0-9a-f]+\b`)
+	numberRegexp = regexp.MustCompile(`\d+`)
+	// ansiRegexp matches the ANSI CSI sequences such as "\x1b[31m"
+	// and the OSC sequences such as hyperlinks.
+	ansiRegexp = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)`)
+	// placeholderRegexp matches the format verbs, including the ones
+	// rendered by fmt for the wrong arguments like "%!d(string=foo)",
+	// and the placeholders in braces.
+	placeholderRegexp = regexp.MustCompile(`%!?[-+# 0]*(?:\d+|\*)?(?:\.(?:\d+|\*))?[a-zA-Z%](?:\([^)]*\))?|\{[^{}]*\}`)
+)
+
+// NormalizeIPs replaces IPv4 and IPv6 addresses with "<ip>".
+func NormalizeIPs(msg string) string {
+	msg = normalizeIPv6(msg)
+	return ipv4Regexp.ReplaceAllString(msg, "<ip>")
+}
+
+// normalizeIPv6 replaces the IPv6 addresses not adjacent to a word
+// character with "<ip>", so that "std::vector" is kept.
+func normalizeIPv6(msg string) string {
+	var sb strings.Builder
+	last := 0
+	for _, loc := range ipv6Regexp.FindAllStringIndex(msg, -1) {
+		start, end := loc[0], loc[1]
+		if !strings.ContainsAny(msg[start:end], "0123456789abcdefABCDEF") {
+			continue
+		}
+		if _, err := netip.ParseAddr(msg[start:end]); err != nil {
+			// The address may be followed by a punctuation.
+			end = start + len(strings.TrimRight(msg[start:end], ":."))
+			if _, err := netip.ParseAddr(msg[start:end]); err != nil {
+				continue
+			}
+		}
+		if start > 0 && isWordByte(msg[start-1]) || end < len(msg) && isWordByte(msg[end]) {
+			continue
+		}
+		sb.WriteString(msg[last:start])
+		sb.WriteString("<ip>")
+		last = end
+	}
+	if last == 0 {
+		return msg
+	}
+	sb.WriteString(msg[last:])
+	return sb.String()
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || isDigit(c) || 'a' <= c|0x20 && c|0x20 <= 'z'
+}
+
+// NormalizeUUIDs replaces UUIDs with "<uuid>".
+func NormalizeUUIDs(msg string) string {
+	return uuidRegexp.ReplaceAllString(msg, "<uuid>")
+}
+
+// NormalizeHexAddresses replaces hexadecimal numbers prefixed with "0x"
+// with "<hex>".
+func NormalizeHexAddresses(msg string) string {
+	return hexRegexp.ReplaceAllString(msg, "<hex>")
+}
+
+// NormalizeNumbers replaces decimal numbers with "<num>".
+func NormalizeNumbers(msg string) string {
+	return numberRegexp.ReplaceAllString(msg, "<num>")
+}
+
+// stripPlaceholders removes the format verbs and the placeholders in braces.
+func stripPlaceholders(msg string) string {
+	return placeholderRegexp.ReplaceAllString(msg, "")
+}
+
+// stripANSI removes the ANSI escape sequences.
+func stripANSI(msg string) string {
+	return ansiRegexp.ReplaceAllString(msg, "")
+}
+
+// digitMask replaces the runs of digits in maskDigits.
+const digitMask = '\x01'
+
+// maskDigits replaces every run of ASCII digits with digitMask.
+// It does not allocate if msg has no digits.
+func maskDigits(msg string) string {
+	i := 0
+	for i < len(msg) && !isDigit(msg[i]) {
+		i++
+	}
+	if i == len(msg) {
+		return msg
+	}
+	var b strings.Builder
+	b.Grow(len(msg))
+	b.WriteString(msg[:i])
+	for ; i < len(msg); i++ {
+		if !isDigit(msg[i]) {
+			b.WriteByte(msg[i])
+		} else if i == 0 || !isDigit(msg[i-1]) {
+			b.WriteByte(digitMask)
+		}
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// ChainNormalizers returns a Normalizer applying normalizers in order.
+// The more specific ones, such as NormalizeUUIDs, should precede the less
+// specific ones, such as NormalizeNumbers.
+func ChainNormalizers(normalizers ...Normalizer) Normalizer {
+	return func(msg string) string {
+		for _, n := range normalizers {
+			msg = n(msg)
+		}
+		return msg
+	}
+}
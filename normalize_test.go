@@ -0,0 +1,225 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizers(t *testing.T) {
+	testCases := []struct {
+		name       string
+		normalizer Normalizer
+		msg        string
+		expected   string
+	}{
+		{
+			name:       "IPv4",
+			normalizer: NormalizeIPs,
+			msg:        "connection from 192.168.0.1 refused",
+			expected:   "connection from <ip> refused",
+		},
+		{
+			name:       "IPv6",
+			normalizer: NormalizeIPs,
+			msg:        "connection from 2001:db8::1 refused",
+			expected:   "connection from <ip> refused",
+		},
+		{
+			name:       "IPv6 variants",
+			normalizer: NormalizeIPs,
+			msg:        "::1, fe80:0:0:0:0:0:0:1 and ::ffff:192.0.2.1 at [2001:db8::]:80.",
+			expected:   "<ip>, <ip> and <ip> at [<ip>]:80.",
+		},
+		{
+			name:       "not IPv6",
+			normalizer: NormalizeIPs,
+			msg:        "std::vector in Foo::Bar :: at 10:30:00 or a:b, dead::beefy",
+			expected:   "std::vector in Foo::Bar :: at 10:30:00 or a:b, dead::beefy",
+		},
+		{
+			name:       "UUID",
+			normalizer: NormalizeUUIDs,
+			msg:        "request 123e4567-e89b-12d3-a456-426614174000 failed",
+			expected:   "request <uuid> failed",
+		},
+		{
+			name:       "hex address",
+			normalizer: NormalizeHexAddresses,
+			msg:        "fault at 0xdeadBEEF",
+			expected:   "fault at <hex>",
+		},
+		{
+			name:       "numbers",
+			normalizer: NormalizeNumbers,
+			msg:        "retry 3 of 10",
+			expected:   "retry <num> of <num>",
+		},
+		{
+			name:       "chain",
+			normalizer: ChainNormalizers(NormalizeUUIDs, NormalizeIPs, NormalizeNumbers),
+			msg:        "user 42 from 10.0.0.1 in 123e4567-e89b-12d3-a456-426614174000",
+			expected:   "user <num> from <ip> in <uuid>",
+		},
+		{
+			name:       "placeholders",
+			normalizer: stripPlaceholders,
+			msg:        "user {name} got %5.2f%% of %-8s, %!d(string=foo) {}",
+			expected:   "user  got  of ,  ",
+		},
+		{
+			name:       "mask digits",
+			normalizer: maskDigits,
+			msg:        "12 retries in 300ms, v2.0",
+			expected:   "\x01 retries in \x01ms, v\x01.\x01",
+		},
+		{
+			name:       "mask digits without digits",
+			normalizer: maskDigits,
+			msg:        "no digits",
+			expected:   "no digits",
+		},
+		{
+			name:       "ANSI",
+			normalizer: stripANSI,
+			msg:        "\x1b[1;31merror\x1b[0m: \x1b]8;;https://example.com\x07link\x1b]8;;\x07",
+			expected:   "error: link",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.normalizer(tc.msg))
+		})
+	}
+}
+
+func TestNormalizerOption(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			Normalizer:             NormalizeNumbers,
+		}))
+
+	logger.Info("retry 1")
+	assert.Contains(t, b.String(), "retry 1")
+
+	b.Reset()
+	logger.Info("retry 2")
+	assert.Empty(t, b.String())
+}
+
+func TestStripPlaceholders(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			StripPlaceholders:      true,
+		}))
+
+	logger.Info("user {alice} logged in")
+	assert.Contains(t, b.String(), "user {alice} logged in")
+	b.Reset()
+	logger.Info("user {bob} logged in")
+	assert.Empty(t, b.String())
+
+	logger.Info("count %!d(string=foo)")
+	assert.Contains(t, b.String(), "count %!d(string=foo)")
+	b.Reset()
+	logger.Info("count %!d(string=bar)")
+	assert.Empty(t, b.String())
+}
+
+func TestStripANSI(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			StripANSI:              true,
+		}))
+
+	logger.Info("\x1b[31mconnection lost\x1b[0m")
+	assert.Contains(t, b.String(), `\u001b[31mconnection lost`)
+	b.Reset()
+	logger.Info("\x1b[33mconnection lost\x1b[0m")
+	logger.Info("connection lost")
+	assert.Empty(t, b.String())
+}
+
+func TestMaskDigits(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			MaskDigits:             true,
+		}))
+
+	logger.Info("retry 12")
+	assert.Contains(t, b.String(), "retry 12")
+	b.Reset()
+	logger.Info("retry 3")
+	assert.Empty(t, b.String())
+
+	// A run of digits is not the same as the literal text.
+	logger.Info("retry x")
+	assert.Contains(t, b.String(), "retry x")
+}
+
+func BenchmarkMaskDigits(b *testing.B) {
+	const msg = "request 12345 failed after 3 retries in 250ms"
+	b.Run("MaskDigits", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			maskDigits(msg)
+		}
+	})
+	b.Run("NormalizeNumbers", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			NormalizeNumbers(msg)
+		}
+	})
+}
+
+func TestKeyPrefixLength(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			KeyPrefixLength:        20,
+		}))
+
+	// "connection refused: " is 20 characters.
+	logger.Info("connection refused: 10.0.0.1:8080")
+	assert.Contains(t, b.String(), "connection refused: 10.0.0.1:8080")
+	b.Reset()
+	logger.Info("connection refused: db.internal:5432")
+	assert.Empty(t, b.String())
+	logger.Info("connection reset: 10.0.0.1:8080")
+	assert.Contains(t, b.String(), "connection reset")
+
+	// The multibyte runes are not cut.
+	b.Reset()
+	logger.Info("接続が拒否されました。接続先を確認してください: host-a")
+	assert.NotEmpty(t, b.String())
+	b.Reset()
+	logger.Info("接続が拒否されました。接続先を確認してください: host-b")
+	assert.Empty(t, b.String())
+}
+
+func TestRunePrefix(t *testing.T) {
+	assert.Equal(t, "ab", runePrefix("abc", 2))
+	assert.Equal(t, "abc", runePrefix("abc", 3))
+	assert.Equal(t, "abc", runePrefix("abc", 4))
+	assert.Equal(t, "日本", runePrefix("日本語", 2))
+	assert.Equal(t, "", runePrefix("日本語", 0))
+}
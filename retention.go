@@ -0,0 +1,29 @@
+package deduplog
+
+import "time"
+
+// observeArrival updates the average interval of the records of e.
+func (h *DedupHandler) observeArrival(e *HistoryEntry) {
+	now := h.monotonicNow()
+	if !e.lastArrival.IsZero() {
+		interval := now.Sub(e.lastArrival)
+		if e.avgInterval == 0 {
+			e.avgInterval = interval
+		} else {
+			e.avgInterval = (e.avgInterval + interval) / 2
+		}
+	}
+	e.lastArrival = now
+}
+
+// retention returns the retention of e for AutoTuneRetention.
+func (h *DedupHandler) retention(e *HistoryEntry) time.Duration {
+	if e.avgInterval <= 0 {
+		return h.opts.HistoryRetentionPeriod
+	}
+	// It is clamped in float64, because the retention of a very short
+	// interval overflows time.Duration.
+	base := float64(h.opts.HistoryRetentionPeriod)
+	r := base * base / float64(e.avgInterval)
+	return time.Duration(min(max(r, float64(h.opts.MinRetention)), float64(h.opts.MaxRetention)))
+}
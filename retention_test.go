@@ -0,0 +1,64 @@
+package deduplog
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoTuneRetention(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Second,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CleanupInterval:        time.Hour,
+			AutoTuneRetention:      true,
+			MaxRetention:           time.Second * 5,
+		})
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	// "chatty" arrives every 100ms, and "rare" every 2s.
+	for i := 0; i < 40; i++ {
+		logger.Info("chatty")
+		if i%20 == 0 {
+			logger.Info("rare")
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+
+	retention := func(key string) time.Duration {
+		h.lock()
+		defer h.unlock()
+		e, ok := h.history.Get(key)
+		require.True(t, ok)
+		return h.retention(e)
+	}
+	// Bounded by MaxRetention.
+	assert.Equal(t, time.Second*5, retention("chatty"))
+	assert.Equal(t, time.Millisecond*500, retention("rare"))
+	assert.Equal(t, time.Millisecond*100, h.Config().MinRetention)
+}
+
+func TestAutoTuneRetentionShortInterval(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: 10 * time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			AutoTuneRetention:      true,
+		})
+	defer h.Close()
+
+	// The retention of these intervals overflows time.Duration, but the
+	// chattier key still gets the longer retention.
+	for _, interval := range []time.Duration{100 * time.Microsecond, 10 * time.Microsecond, time.Nanosecond} {
+		assert.Equal(t, 100*time.Minute, h.retention(&HistoryEntry{avgInterval: interval}), interval)
+	}
+	assert.Equal(t, time.Minute, h.retention(&HistoryEntry{avgInterval: time.Hour * 24}))
+}
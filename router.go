@@ -0,0 +1,82 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+)
+
+// levelRouter dispatches records to handlers by level.
+type levelRouter struct {
+	levels   []slog.Level
+	handlers []slog.Handler
+}
+
+// NewDedupLevelRouter creates a DedupHandler which deduplicates records
+// and then dispatches them to the handler chosen by level. A record goes
+// to the handler with the highest level not higher than the record level.
+// The handler with the lowest level is the default for the records whose
+// level is lower than any of them.
+func NewDedupLevelRouter(ctx context.Context, handlers map[slog.Level]slog.Handler, opts *HandlerOptions) *DedupHandler {
+	return NewDedupHandler(ctx, newLevelRouter(handlers), opts)
+}
+
+func newLevelRouter(handlers map[slog.Level]slog.Handler) *levelRouter {
+	lr := &levelRouter{}
+	for level := range handlers {
+		lr.levels = append(lr.levels, level)
+	}
+	sort.Slice(lr.levels, func(i, j int) bool {
+		return lr.levels[i] < lr.levels[j]
+	})
+	for _, level := range lr.levels {
+		lr.handlers = append(lr.handlers, handlers[level])
+	}
+	return lr
+}
+
+func (lr *levelRouter) route(level slog.Level) slog.Handler {
+	if len(lr.handlers) == 0 {
+		return nil
+	}
+	i := sort.Search(len(lr.levels), func(i int) bool {
+		return lr.levels[i] > level
+	})
+	return lr.handlers[max(i-1, 0)]
+}
+
+func (lr *levelRouter) Enabled(ctx context.Context, level slog.Level) bool {
+	h := lr.route(level)
+	return h != nil && h.Enabled(ctx, level)
+}
+
+func (lr *levelRouter) Handle(ctx context.Context, r slog.Record) error {
+	h := lr.route(r.Level)
+	if h == nil {
+		return nil
+	}
+	return h.Handle(ctx, r)
+}
+
+func (lr *levelRouter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return lr.derive(func(h slog.Handler) slog.Handler {
+		return h.WithAttrs(attrs)
+	})
+}
+
+func (lr *levelRouter) WithGroup(name string) slog.Handler {
+	return lr.derive(func(h slog.Handler) slog.Handler {
+		return h.WithGroup(name)
+	})
+}
+
+func (lr *levelRouter) derive(f func(slog.Handler) slog.Handler) *levelRouter {
+	nlr := &levelRouter{
+		levels:   lr.levels,
+		handlers: make([]slog.Handler, len(lr.handlers)),
+	}
+	for i, h := range lr.handlers {
+		nlr.handlers[i] = f(h)
+	}
+	return nlr
+}
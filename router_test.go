@@ -0,0 +1,43 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupLevelRouter(t *testing.T) {
+	infoBuf := new(bytes.Buffer)
+	errorBuf := new(bytes.Buffer)
+	logger := slog.New(NewDedupLevelRouter(context.Background(),
+		map[slog.Level]slog.Handler{
+			slog.LevelInfo:  slog.NewJSONHandler(infoBuf, nil),
+			slog.LevelError: slog.NewJSONHandler(errorBuf, nil),
+		},
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			DedupLogLevel:          slog.LevelError,
+		}))
+	require.NotNil(t, logger)
+
+	logger.Error("test")
+	assert.Empty(t, infoBuf.String())
+	assert.NotEmpty(t, errorBuf.String())
+
+	// The suppressed log goes nowhere.
+	errorBuf.Reset()
+	logger.Error("test")
+	assert.Empty(t, infoBuf.String())
+	assert.Empty(t, errorBuf.String())
+
+	// Warn goes to the handler for Info.
+	logger.Warn("test2")
+	assert.NotEmpty(t, infoBuf.String())
+	assert.Empty(t, errorBuf.String())
+}
@@ -0,0 +1,39 @@
+package deduplog
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SelfCheck verifies that h is usable and returns an error describing every
+// problem found, or nil. It is intended for the health checks at startup.
+// It reports ErrHandlerClosed if h is closed.
+func (h *DedupHandler) SelfCheck() error {
+	if h.closed.Load() {
+		return ErrHandlerClosed
+	}
+	var errs []error
+	if h.wrapped() == nil {
+		errs = append(errs, errors.New("wrapped handler is nil"))
+	}
+	h.lock()
+	opts := h.opts
+	h.unlock()
+	if opts.MaxHistoryCount <= 0 {
+		errs = append(errs, fmt.Errorf("MaxHistoryCount is not positive: %d", opts.MaxHistoryCount))
+	}
+	if opts.HistoryRetentionPeriod <= 0 {
+		errs = append(errs, fmt.Errorf("HistoryRetentionPeriod is not positive: %v", opts.HistoryRetentionPeriod))
+	}
+	if opts.CleanupInterval <= 0 {
+		errs = append(errs, fmt.Errorf("CleanupInterval is not positive: %v", opts.CleanupInterval))
+	}
+	if h.cleanupDone != nil {
+		select {
+		case <-h.cleanupDone:
+			errs = append(errs, errors.New("background cleanup is not running"))
+		default:
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,62 @@
+package deduplog
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfCheck(t *testing.T) {
+	newHandler := func(ctx context.Context, handler slog.Handler) *DedupHandler {
+		return NewDedupHandler(ctx, handler, &HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		h := newHandler(context.Background(), slog.Default().Handler())
+		defer h.Close()
+		require.NoError(t, h.SelfCheck())
+		require.NoError(t, h.WithAttrs([]slog.Attr{slog.Int("a", 1)}).(*DedupHandler).SelfCheck())
+	})
+
+	t.Run("nil handler", func(t *testing.T) {
+		h := newHandler(context.Background(), nil)
+		defer h.Close()
+		assert.ErrorContains(t, h.SelfCheck(), "wrapped handler is nil")
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		h := newHandler(context.Background(), slog.Default().Handler())
+		defer h.Close()
+		h.opts.MaxHistoryCount = 0
+		h.opts.HistoryRetentionPeriod = -time.Second
+		h.opts.CleanupInterval = 0
+		err := h.SelfCheck()
+		assert.ErrorContains(t, err, "MaxHistoryCount is not positive")
+		assert.ErrorContains(t, err, "HistoryRetentionPeriod is not positive")
+		assert.ErrorContains(t, err, "CleanupInterval is not positive")
+	})
+
+	t.Run("cleanup stopped", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		h := newHandler(ctx, slog.Default().Handler())
+		defer h.Close()
+		cancel()
+		assert.Eventually(t, func() bool {
+			err := h.SelfCheck()
+			return err != nil && err.Error() == "background cleanup is not running"
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		h := newHandler(context.Background(), slog.Default().Handler())
+		require.NoError(t, h.Close())
+		assert.ErrorIs(t, h.SelfCheck(), ErrHandlerClosed)
+	})
+}
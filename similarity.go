@@ -0,0 +1,65 @@
+package deduplog
+
+import (
+	"log/slog"
+	"slices"
+)
+
+// lookupSimilar looks for the recently emitted key similar to key, and
+// returns it with its entry if a record of it would be a duplicate.
+// Otherwise, it returns key as is.
+func (h *DedupHandler) lookupSimilar(key string, r slog.Record) (string, *HistoryEntry, bool) {
+	for i := len(h.recentKeys) - 1; i >= 0; i-- {
+		k := h.recentKeys[i]
+		if k == key || similarity(key, k) < h.opts.SimilarityThreshold {
+			continue
+		}
+		if e, dup := h.lookupDuplicate(k, r); dup {
+			return k, e, true
+		}
+	}
+	return key, nil, false
+}
+
+// addRecentKey remembers key as the most recently emitted one, and forgets
+// the oldest one beyond SimilarityCandidates.
+func (h *DedupHandler) addRecentKey(key string) {
+	if i := slices.Index(h.recentKeys, key); i >= 0 {
+		h.recentKeys = slices.Delete(h.recentKeys, i, i+1)
+	}
+	h.recentKeys = append(h.recentKeys, key)
+	if len(h.recentKeys) > h.opts.SimilarityCandidates {
+		h.recentKeys = slices.Delete(h.recentKeys, 0, 1)
+	}
+}
+
+// similarity returns 1 minus the Levenshtein distance between a and b
+// normalized by the length of the longer one.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	n := max(len(ra), len(rb))
+	if n == 0 {
+		return 1
+	}
+	return 1 - float64(editDistance(ra, rb))/float64(n)
+}
+
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,58 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimilarity(t *testing.T) {
+	assert.Equal(t, 1.0, similarity("", ""))
+	assert.Equal(t, 1.0, similarity("abc", "abc"))
+	assert.Equal(t, 0.0, similarity("abc", "xyz"))
+	assert.InDelta(t, 1-1.0/18, similarity("processed 41 items", "processed 42 items"), 1e-9)
+	assert.InDelta(t, 0.5, similarity("ab", "abcd"), 1e-9)
+}
+
+func TestSimilarityThreshold(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			SimilarityThreshold:    0.9,
+		})
+	logger := slog.New(h)
+
+	logger.Info("processed 41 items")
+	logger.Info("processed 42 items")
+	logger.Info("processed 43 items")
+	logger.Info("failed")
+
+	assert.Equal(t, 2, bytes.Count(b.Bytes(), []byte("\n")))
+	assert.Contains(t, b.String(), "processed 41 items")
+	assert.NotContains(t, b.String(), "processed 42 items")
+	assert.Equal(t, []KeyCount{{Key: "processed 41 items", Count: 2}}, h.TopSuppressed(10))
+}
+
+func TestSimilarityCandidates(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			SimilarityThreshold:    0.9,
+			SimilarityCandidates:   1,
+		}))
+
+	logger.Info("processed 41 items")
+	logger.Info("failed")
+	// "processed 41 items" is no longer a candidate.
+	logger.Info("processed 42 items")
+
+	assert.Equal(t, 3, bytes.Count(b.Bytes(), []byte("\n")))
+}
@@ -0,0 +1,123 @@
+package deduplog
+
+// snapshotCache is the history while rangeSnapshot iterates the built-in
+// map without the lock. base is frozen during the iteration, and the
+// changes go to delta and deleted. The entries of base are copied to delta
+// before they are returned, because the handler modifies the returned
+// entries.
+type snapshotCache struct {
+	base  mapCache
+	delta mapCache
+	// deleted are the keys deleted from base. They are never in delta.
+	deleted map[string]struct{}
+	// added is the number of the keys in delta but not in base.
+	added int
+}
+
+func newSnapshotCache(base mapCache) *snapshotCache {
+	return &snapshotCache{
+		base:    base,
+		delta:   make(mapCache),
+		deleted: make(map[string]struct{}),
+	}
+}
+
+func (c *snapshotCache) Get(key string) (*HistoryEntry, bool) {
+	if e, ok := c.delta[key]; ok {
+		return e, true
+	}
+	if _, ok := c.deleted[key]; ok {
+		return nil, false
+	}
+	e, ok := c.base[key]
+	if !ok {
+		return nil, false
+	}
+	return c.promote(key, e), true
+}
+
+// promote copies e of base for key to delta.
+func (c *snapshotCache) promote(key string, e *HistoryEntry) *HistoryEntry {
+	ce := *e
+	c.delta[key] = &ce
+	return &ce
+}
+
+func (c *snapshotCache) Set(key string, e *HistoryEntry) {
+	if _, ok := c.delta[key]; !ok {
+		if _, ok := c.base[key]; !ok {
+			c.added += 1
+		}
+	}
+	c.delta[key] = e
+	delete(c.deleted, key)
+}
+
+func (c *snapshotCache) Delete(key string) {
+	_, inDelta := c.delta[key]
+	_, inBase := c.base[key]
+	delete(c.delta, key)
+	if inBase {
+		c.deleted[key] = struct{}{}
+	} else if inDelta {
+		c.added -= 1
+	}
+}
+
+func (c *snapshotCache) Len() int {
+	return len(c.base) - len(c.deleted) + c.added
+}
+
+// Range copies all the entries of base to delta first,
+// because f may modify them.
+func (c *snapshotCache) Range(f func(key string, e *HistoryEntry) bool) {
+	for k, v := range c.base {
+		if _, ok := c.delta[k]; ok {
+			continue
+		}
+		if _, ok := c.deleted[k]; ok {
+			continue
+		}
+		c.promote(k, v)
+	}
+	c.delta.Range(f)
+}
+
+// merge applies the changes to base and returns it.
+// c must not be used after that.
+func (c *snapshotCache) merge() mapCache {
+	for k := range c.deleted {
+		delete(c.base, k)
+	}
+	for k, v := range c.delta {
+		c.base[k] = v
+	}
+	return c.base
+}
+
+// rangeSnapshot calls f for each entry of the history as of the call until
+// f returns false. f must not modify the entries. If the history is the
+// built-in map, f is called without the lock, so that a long iteration such
+// as ExportState does not block the logging. Otherwise, f is called with
+// the lock held.
+func (h *DedupHandler) rangeSnapshot(f func(key string, e *HistoryEntry) bool) {
+	h.lock()
+	base, ok := h.history.(mapCache)
+	if !ok {
+		defer h.unlock()
+		h.history.Range(f)
+		return
+	}
+	snap := newSnapshotCache(base)
+	h.history = snap
+	h.unlock()
+
+	base.Range(f)
+
+	h.lock()
+	defer h.unlock()
+	// Reset may have replaced the history.
+	if h.history == Cache(snap) {
+		h.history = snap.merge()
+	}
+}
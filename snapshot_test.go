@@ -0,0 +1,121 @@
+package deduplog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotCache(t *testing.T) {
+	base := mapCache{
+		"a": &HistoryEntry{seq: 1},
+		"b": &HistoryEntry{seq: 2},
+	}
+	c := newSnapshotCache(base)
+
+	e, ok := c.Get("a")
+	require.True(t, ok)
+	e.seq = 10
+	c.Delete("b")
+	c.Set("c", &HistoryEntry{seq: 3})
+	c.Delete("c")
+	c.Set("d", &HistoryEntry{seq: 4})
+	c.Set("b", &HistoryEntry{seq: 5})
+	assert.Equal(t, 3, c.Len())
+
+	// base is not changed until merge.
+	assert.Equal(t, uint64(1), base["a"].seq)
+	assert.Equal(t, uint64(2), base["b"].seq)
+	assert.Len(t, base, 2)
+
+	seqs := map[string]uint64{}
+	c.Range(func(k string, e *HistoryEntry) bool {
+		seqs[k] = e.seq
+		return true
+	})
+	assert.Equal(t, map[string]uint64{"a": 10, "b": 5, "d": 4}, seqs)
+
+	merged := c.merge()
+	assert.Len(t, merged, 3)
+	assert.Equal(t, uint64(10), merged["a"].seq)
+	assert.Equal(t, uint64(5), merged["b"].seq)
+	assert.Equal(t, uint64(4), merged["d"].seq)
+}
+
+func TestRangeSnapshotDoesNotBlockLogging(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod: time.Minute,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+	})
+	defer h.Close()
+	logger := slog.New(h)
+	logger.Info("foo")
+	logger.Info("bar")
+
+	var keys []string
+	h.rangeSnapshot(func(k string, e *HistoryEntry) bool {
+		keys = append(keys, k)
+		// It would deadlock if the lock were held.
+		logger.Info("foo")
+		logger.Info(fmt.Sprintf("baz %d", len(keys)))
+		return true
+	})
+	assert.ElementsMatch(t, []string{"foo", "bar"}, keys)
+	assert.Equal(t, 1, ch.counts["foo"])
+	assert.Equal(t, 1, ch.counts["baz 1"])
+	assert.Equal(t, 1, ch.counts["baz 2"])
+
+	// The changes during the iteration are kept.
+	assert.Equal(t, []KeyCount{
+		{Key: "bar", Count: 0},
+		{Key: "baz 1", Count: 0},
+		{Key: "baz 2", Count: 0},
+		{Key: "foo", Count: 2},
+	}, h.DumpHistory())
+	assert.IsType(t, mapCache{}, h.history)
+}
+
+// BenchmarkHandleDuringExport measures the latency of logging while
+// the large history is exported concurrently.
+func BenchmarkHandleDuringExport(b *testing.B) {
+	const historyCount = 100000
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Hour,
+			MaxHistoryCount:        historyCount * 2,
+		})
+	defer h.Close()
+	logger := slog.New(h)
+	for i := 0; i < historyCount; i++ {
+		logger.Info(fmt.Sprintf("message %d", i))
+	}
+
+	var stop atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for !stop.Load() {
+			_ = h.ExportState(io.Discard, nil)
+		}
+	}()
+
+	b.ResetTimer()
+	var worst time.Duration
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		logger.Info(fmt.Sprintf("message %d", i%(historyCount*2)))
+		worst = max(worst, time.Since(start))
+	}
+	b.StopTimer()
+	stop.Store(true)
+	<-done
+	b.ReportMetric(float64(worst.Microseconds()), "worst-us")
+}
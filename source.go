@@ -0,0 +1,27 @@
+package deduplog
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// sourceCache caches the results of resolveSource by PC.
+// The number of entries is bounded by the number of log call sites.
+var sourceCache sync.Map
+
+// sourceOf returns "file:line" of pc.
+func sourceOf(pc uintptr) string {
+	if s, ok := sourceCache.Load(pc); ok {
+		return s.(string)
+	}
+	s := resolveSource(pc)
+	sourceCache.Store(pc, s)
+	return s
+}
+
+func resolveSource(pc uintptr) string {
+	fs := runtime.CallersFrames([]uintptr{pc})
+	f, _ := fs.Next()
+	return fmt.Sprintf("%s:%d", f.File, f.Line)
+}
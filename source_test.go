@@ -0,0 +1,70 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyBySource(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := slog.New(NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			KeyBySource:            true,
+		}))
+	require.NotNil(t, logger)
+
+	for i := 0; i < 2; i++ {
+		logger.Info("test")
+	}
+	assert.Equal(t, 1, bytes.Count(b.Bytes(), []byte("\n")))
+
+	// The same message from another call site is not deduplicated.
+	b.Reset()
+	logger.Info("test")
+	assert.NotEmpty(t, b.String())
+}
+
+func TestKeyBySourceWithoutPC(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			KeyBySource:            true,
+		})
+
+	// The records without the PC fall back to the message-only key.
+	err := h.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "test", 0))
+	require.NoError(t, err)
+	assert.NotEmpty(t, b.String())
+	assert.Contains(t, h.history, "test")
+
+	b.Reset()
+	err = h.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "test", 0))
+	require.NoError(t, err)
+	assert.Empty(t, b.String())
+}
+
+func BenchmarkSourceOf(b *testing.B) {
+	var pcs [1]uintptr
+	runtime.Callers(1, pcs[:])
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sourceOf(pcs[0])
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			resolveSource(pcs[0])
+		}
+	})
+}
@@ -0,0 +1,311 @@
+package deduplog
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// StateVersion is the version of State written by ExportState.
+const StateVersion = 1
+
+// State is the exported history of a DedupHandler.
+type State struct {
+	Version int
+	Entries []StateEntry
+}
+
+// StateEntry is the state of a key in State. The times are relative to
+// the export, so that they are valid after a restart.
+type StateEntry struct {
+	Key string
+	// TTL is the time until the key expires.
+	TTL time.Duration
+	// Age is the time since the key was inserted.
+	Age        time.Duration
+	Seq        uint64
+	WindowID   uint64
+	Suppressed uint64
+	Level      slog.Level
+	// LastEmitted is the time when a record of the key was last emitted,
+	// or zero if it has not been emitted.
+	LastEmitted time.Time
+}
+
+// StateCodec encodes and decodes State.
+type StateCodec interface {
+	Encode(w io.Writer, s *State) error
+	Decode(r io.Reader, s *State) error
+}
+
+var (
+	// GobStateCodec encodes State with encoding/gob. It is the default.
+	GobStateCodec StateCodec = gobStateCodec{}
+	// JSONStateCodec encodes State with encoding/json.
+	JSONStateCodec StateCodec = jsonStateCodec{}
+)
+
+type gobStateCodec struct{}
+
+func (gobStateCodec) Encode(w io.Writer, s *State) error {
+	return gob.NewEncoder(w).Encode(s)
+}
+
+func (gobStateCodec) Decode(r io.Reader, s *State) error {
+	return gob.NewDecoder(r).Decode(s)
+}
+
+type jsonStateCodec struct{}
+
+func (jsonStateCodec) Encode(w io.Writer, s *State) error {
+	return json.NewEncoder(w).Encode(s)
+}
+
+func (jsonStateCodec) Decode(r io.Reader, s *State) error {
+	return json.NewDecoder(r).Decode(s)
+}
+
+// ExportState writes the unexpired history to w with codec, or
+// GobStateCodec if codec is nil. The pending summaries are not included.
+// The logging is not blocked while the history is copied, unless
+// NewCache is set.
+func (h *DedupHandler) ExportState(w io.Writer, codec StateCodec) error {
+	if codec == nil {
+		codec = GobStateCodec
+	}
+	s := State{Version: StateVersion}
+	h.lock()
+	now := h.monotonicNow()
+	h.unlock()
+	h.rangeSnapshot(func(k string, v *HistoryEntry) bool {
+		if now.After(v.expireTime) {
+			return true
+		}
+		s.Entries = append(s.Entries, StateEntry{
+			Key:         k,
+			TTL:         v.expireTime.Sub(now),
+			Age:         now.Sub(v.firstSeen),
+			Seq:         v.seq,
+			WindowID:    v.windowID,
+			Suppressed:  v.suppressed,
+			Level:       v.level,
+			LastEmitted: v.lastEmitted,
+		})
+		return true
+	})
+	sort.Slice(s.Entries, func(i, j int) bool {
+		return s.Entries[i].Key < s.Entries[j].Key
+	})
+	return codec.Encode(w, &s)
+}
+
+// ImportState reads the history written by ExportState from r with codec,
+// or GobStateCodec if codec is nil, and merges it like MergeFrom. It
+// returns an error if the version of the state is newer than StateVersion.
+func (h *DedupHandler) ImportState(r io.Reader, codec StateCodec) error {
+	if codec == nil {
+		codec = GobStateCodec
+	}
+	var s State
+	if err := codec.Decode(r, &s); err != nil {
+		return err
+	}
+	if s.Version > StateVersion {
+		return fmt.Errorf("unsupported state version: %d", s.Version)
+	}
+	h.lock()
+	now := h.monotonicNow()
+	h.unlock()
+	h.importEntries(s.Entries, now)
+	return nil
+}
+
+// importChunkSize is the number of the entries ImportStateReader decodes
+// before inserting them.
+const importChunkSize = 1024
+
+// ImportStateReader is the same as ImportState with JSONStateCodec, but
+// decodes and inserts the entries in chunks, so that the memory does not
+// grow with the size of the state. The entries are inserted as they are
+// decoded, so some of them may have been inserted if it returns an error.
+// Like the other insertions, MaxHistoryCount is kept by evicting the keys
+// expiring first.
+func (h *DedupHandler) ImportStateReader(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case "Version":
+			var version int
+			if err := dec.Decode(&version); err != nil {
+				return err
+			}
+			if version > StateVersion {
+				return fmt.Errorf("unsupported state version: %d", version)
+			}
+		case "Entries":
+			if err := h.importEntriesFrom(dec); err != nil {
+				return err
+			}
+		default:
+			// Skip the fields added in the future.
+			var v json.RawMessage
+			if err := dec.Decode(&v); err != nil {
+				return err
+			}
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// importEntriesFrom decodes the array of StateEntry from dec in chunks
+// and inserts them.
+func (h *DedupHandler) importEntriesFrom(dec *json.Decoder) error {
+	// The TTLs of all the chunks are relative to the same time,
+	// so that their order is kept.
+	h.lock()
+	now := h.monotonicNow()
+	h.unlock()
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("unexpected token for Entries: %v", t)
+	}
+	chunk := make([]StateEntry, 0, importChunkSize)
+	for dec.More() {
+		var se StateEntry
+		if err := dec.Decode(&se); err != nil {
+			return err
+		}
+		chunk = append(chunk, se)
+		if len(chunk) == importChunkSize {
+			h.importEntries(chunk, now)
+			chunk = chunk[:0]
+		}
+	}
+	h.importEntries(chunk, now)
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("unexpected token: %v, expected %v", t, delim)
+	}
+	return nil
+}
+
+// importEntries merges entries into the history. For the keys already in
+// the history, the later expiration time is kept. The TTLs of entries are
+// relative to now.
+func (h *DedupHandler) importEntries(entries []StateEntry, now time.Time) {
+	h.lock()
+	defer h.unlock()
+	var news []importedEntry
+	index := make(map[string]int)
+	for _, se := range entries {
+		if se.TTL <= 0 {
+			continue
+		}
+		expireTime := now.Add(se.TTL)
+		if e, ok := h.history.Get(se.Key); ok {
+			if expireTime.After(e.expireTime) {
+				e.expireTime = expireTime
+			}
+			continue
+		}
+		ie := importedEntry{se: se, entry: HistoryEntry{expireTime: expireTime, level: se.Level}}
+		if i, ok := index[se.Key]; ok {
+			if expireTime.After(news[i].entry.expireTime) {
+				news[i] = ie
+			}
+			continue
+		}
+		index[se.Key] = len(news)
+		news = append(news, ie)
+	}
+	// Insert the keys evicted first first, so that they are evicted first.
+	sort.SliceStable(news, func(i, j int) bool {
+		return h.evictBefore(&news[i].entry, &news[j].entry)
+	})
+	for _, ie := range news[h.makeRoomForImport(news):] {
+		e, _ := h.touchHistory(ie.se.Key)
+		e.expireTime = ie.entry.expireTime
+		e.firstSeen = now.Add(-ie.se.Age)
+		e.seq = ie.se.Seq
+		e.windowID = ie.se.WindowID
+		e.suppressed = ie.se.Suppressed
+		e.level = ie.se.Level
+		e.lastEmitted = ie.se.LastEmitted
+	}
+}
+
+// importedEntry is a StateEntry of a key not in the history, with the
+// fields of HistoryEntry deciding its eviction order.
+type importedEntry struct {
+	se    StateEntry
+	entry HistoryEntry
+}
+
+// makeRoomForImport evicts the keys which would be evicted before the new
+// ones in news, sorted in the eviction order, so that they fit in
+// MaxHistoryCount. It returns the number of the new ones at the head of
+// news which do not fit. The history is sorted once instead of scanning it
+// for each new key. It must be called with the lock held.
+func (h *DedupHandler) makeRoomForImport(news []importedEntry) int {
+	excess := h.history.Len() + len(news) - h.opts.MaxHistoryCount
+	if excess <= 0 || h.opts.EvictionPolicy == EvictionPolicyRejectNew {
+		return 0
+	}
+	protectedKey, protected := "", false
+	if h.opts.ProtectHottestOnEvict && h.history.Len() > 1 {
+		protectedKey, protected = h.hottestKey()
+	}
+	type keyEntry struct {
+		key   string
+		entry *HistoryEntry
+	}
+	olds := make([]keyEntry, 0, h.history.Len())
+	h.history.Range(func(k string, v *HistoryEntry) bool {
+		if !protected || k != protectedKey {
+			olds = append(olds, keyEntry{key: k, entry: v})
+		}
+		return true
+	})
+	sort.Slice(olds, func(i, j int) bool {
+		return h.evictBefore(olds[i].entry, olds[j].entry)
+	})
+	skipped, evicted := 0, 0
+	for ; excess > 0; excess-- {
+		switch {
+		case evicted < len(olds) &&
+			(skipped == len(news) || !h.evictBefore(&news[skipped].entry, olds[evicted].entry)):
+			h.deleteHistory(olds[evicted].key, olds[evicted].entry)
+			h.metrics.IncEvicted()
+			evicted += 1
+		case skipped < len(news):
+			skipped += 1
+		default:
+			return skipped
+		}
+	}
+	return skipped
+}
@@ -0,0 +1,219 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStateTestHandler(b io.Writer) *DedupHandler {
+	return NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			AddSequence:            true,
+		})
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	for name, codec := range map[string]StateCodec{
+		"default": nil,
+		"gob":     GobStateCodec,
+		"json":    JSONStateCodec,
+	} {
+		t.Run(name, func(t *testing.T) {
+			src := newStateTestHandler(io.Discard)
+			logger := slog.New(src)
+			logger.Info("foo")
+			logger.Info("foo")
+			logger.Warn("bar")
+
+			state := new(bytes.Buffer)
+			require.NoError(t, src.ExportState(state, codec))
+
+			b := new(bytes.Buffer)
+			dst := newStateTestHandler(b)
+			require.NoError(t, dst.ImportState(state, codec))
+			assert.Equal(t, src.DumpHistory(), dst.DumpHistory())
+			srcLast, _ := src.LastEmitted("bar")
+			dstLast, ok := dst.LastEmitted("bar")
+			assert.True(t, ok)
+			assert.True(t, srcLast.Equal(dstLast))
+
+			// The imported keys are suppressed.
+			slog.New(dst).Info("foo")
+			assert.Empty(t, b.String())
+		})
+	}
+}
+
+func TestStateExpiration(t *testing.T) {
+	src := newStateTestHandler(io.Discard)
+	clock := newFakeClock()
+	setClock(src, clock)
+	slog.New(src).Info("old")
+	clock.Advance(time.Second * 30)
+	slog.New(src).Info("new")
+
+	state := new(bytes.Buffer)
+	require.NoError(t, src.ExportState(state, JSONStateCodec))
+	var s State
+	require.NoError(t, json.Unmarshal(state.Bytes(), &s))
+	assert.Equal(t, StateVersion, s.Version)
+	require.Len(t, s.Entries, 2)
+	assert.Equal(t, "new", s.Entries[0].Key)
+	assert.Equal(t, time.Minute, s.Entries[0].TTL)
+	assert.Equal(t, "old", s.Entries[1].Key)
+	assert.Equal(t, time.Second*30, s.Entries[1].TTL)
+	assert.Equal(t, time.Second*30, s.Entries[1].Age)
+}
+
+func TestStateForwardCompatibility(t *testing.T) {
+	type futureEntry struct {
+		StateEntry
+		Future string
+	}
+	type futureState struct {
+		Version int
+		Entries []futureEntry
+		Future  int
+	}
+	fs := futureState{
+		Version: StateVersion,
+		Entries: []futureEntry{{StateEntry: StateEntry{Key: "foo", TTL: time.Minute, Seq: 1}, Future: "x"}},
+		Future:  1,
+	}
+
+	t.Run("json", func(t *testing.T) {
+		data, err := json.Marshal(fs)
+		require.NoError(t, err)
+		h := newStateTestHandler(io.Discard)
+		require.NoError(t, h.ImportState(bytes.NewReader(data), JSONStateCodec))
+		assert.Equal(t, []KeyCount{{Key: "foo"}}, h.DumpHistory())
+	})
+
+	t.Run("gob", func(t *testing.T) {
+		type gobFutureEntry struct {
+			Key    string
+			TTL    time.Duration
+			Seq    uint64
+			Future string
+		}
+		type gobFutureState struct {
+			Version int
+			Entries []gobFutureEntry
+			Future  int
+		}
+		data := new(bytes.Buffer)
+		require.NoError(t, gob.NewEncoder(data).Encode(gobFutureState{
+			Version: StateVersion,
+			Entries: []gobFutureEntry{{Key: "foo", TTL: time.Minute, Seq: 1, Future: "x"}},
+			Future:  1,
+		}))
+		h := newStateTestHandler(io.Discard)
+		require.NoError(t, h.ImportState(data, GobStateCodec))
+		assert.Equal(t, []KeyCount{{Key: "foo"}}, h.DumpHistory())
+	})
+
+	t.Run("newer version", func(t *testing.T) {
+		fs := fs
+		fs.Version = StateVersion + 1
+		data, err := json.Marshal(fs)
+		require.NoError(t, err)
+		h := newStateTestHandler(io.Discard)
+		assert.Error(t, h.ImportState(bytes.NewReader(data), JSONStateCodec))
+	})
+}
+
+func TestImportStateReader(t *testing.T) {
+	const entryCount = importChunkSize*16 + 100
+	src := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Hour,
+			MaxHistoryCount:        entryCount,
+		})
+	defer src.Close()
+	clock := newFakeClock()
+	setClock(src, clock)
+	for i := 0; i < entryCount; i++ {
+		slog.New(src).Info(fmt.Sprintf("message %d", i))
+		clock.Advance(time.Millisecond)
+	}
+	state := new(bytes.Buffer)
+	require.NoError(t, src.ExportState(state, JSONStateCodec))
+
+	t.Run("all", func(t *testing.T) {
+		dst := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+			&HandlerOptions{
+				HistoryRetentionPeriod: time.Hour,
+				MaxHistoryCount:        entryCount,
+			})
+		defer dst.Close()
+		require.NoError(t, dst.ImportStateReader(bytes.NewReader(state.Bytes())))
+		assert.Equal(t, src.DumpHistory(), dst.DumpHistory())
+	})
+
+	t.Run("capped", func(t *testing.T) {
+		// Most of the chunks are imported into the full history.
+		const maxHistoryCount = importChunkSize*4 + 10
+		dst := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+			&HandlerOptions{
+				HistoryRetentionPeriod: time.Hour,
+				MaxHistoryCount:        maxHistoryCount,
+			})
+		defer dst.Close()
+		require.NoError(t, dst.ImportStateReader(bytes.NewReader(state.Bytes())))
+		assert.Equal(t, maxHistoryCount, historyLen(dst))
+		// The keys expiring last are kept.
+		for i := entryCount - maxHistoryCount; i < entryCount; i++ {
+			_, ok := dst.LastEmitted(fmt.Sprintf("message %d", i))
+			require.True(t, ok, i)
+		}
+	})
+
+	t.Run("merged", func(t *testing.T) {
+		dst := NewDedupHandler(context.Background(), slog.NewJSONHandler(io.Discard, nil),
+			&HandlerOptions{
+				HistoryRetentionPeriod: time.Hour,
+				MaxHistoryCount:        3,
+			})
+		defer dst.Close()
+		slog.New(dst).Info("x")
+		slog.New(dst).Info("y")
+		data := fmt.Sprintf(`{"Version":1,"Entries":[`+
+			`{"Key":"a","TTL":%d},{"Key":"b","TTL":%d},{"Key":"c","TTL":%d},{"Key":"d","TTL":%d}]}`,
+			30*time.Minute, 2*time.Hour, 3*time.Hour, 10*time.Minute)
+		require.NoError(t, dst.ImportStateReader(bytes.NewReader([]byte(data))))
+		// The keys in the history and the imported ones are evicted in
+		// one order.
+		assert.Equal(t, []KeyCount{{Key: "b"}, {Key: "c"}, {Key: "y"}}, dst.DumpHistory())
+	})
+
+	t.Run("newer version", func(t *testing.T) {
+		dst := newStateTestHandler(io.Discard)
+		data := fmt.Sprintf(`{"Version":%d,"Entries":[]}`, StateVersion+1)
+		assert.Error(t, dst.ImportStateReader(bytes.NewReader([]byte(data))))
+	})
+
+	t.Run("unknown fields", func(t *testing.T) {
+		dst := newStateTestHandler(io.Discard)
+		data := `{"Version":1,"Future":{"x":[1]},"Entries":[{"Key":"foo","TTL":60000000000,"Future":1}]}`
+		require.NoError(t, dst.ImportStateReader(bytes.NewReader([]byte(data))))
+		assert.Equal(t, []KeyCount{{Key: "foo"}}, dst.DumpHistory())
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		dst := newStateTestHandler(io.Discard)
+		assert.Error(t, dst.ImportStateReader(bytes.NewReader([]byte(`{"Entries":{}}`))))
+		assert.Error(t, dst.ImportStateReader(bytes.NewReader([]byte(`[]`))))
+	})
+}
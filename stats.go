@@ -0,0 +1,113 @@
+package deduplog
+
+import (
+	"log/slog"
+	"maps"
+	"time"
+)
+
+// Stats is a snapshot of the counters of a DedupHandler.
+type Stats struct {
+	// Name is HandlerOptions.Name of the handler.
+	Name string
+	// Emitted is the number of records passed to the wrapped handler.
+	// The records the wrapped handler is not enabled for are not included.
+	Emitted int64
+	// Filtered is the number of records not handled because the wrapped
+	// handler is not enabled for their levels.
+	Filtered int64
+	// Suppressed is the number of records suppressed as duplicates.
+	Suppressed int64
+	// SuppressedByLevel breaks down Suppressed by the record level.
+	SuppressedByLevel map[slog.Level]int64
+	// Throttled is the number of records suppressed by GlobalMaxEmitRate.
+	Throttled int64
+	// EmitTimeouts is the number of records whose emission timed out.
+	EmitTimeouts int64
+	// AsyncDropped is the number of records dropped because the queue for
+	// AsyncEmit was full.
+	AsyncDropped int64
+	// AsyncErrors is the number of errors of the wrapped handler
+	// with AsyncEmit.
+	AsyncErrors int64
+	// AuditErrors is the number of errors returned by AuditHandler.
+	AuditErrors int64
+	// HistoryPeak is the largest number of the keys in the history since
+	// the last compaction of CompactionThreshold or Reset.
+	HistoryPeak int
+	// Compactions is the number of the compactions of CompactionThreshold.
+	Compactions int64
+	// WindowChecked and WindowSuppressed are the numbers of the records
+	// checked for duplication and suppressed in the last HitRatioWindow.
+	WindowChecked    int64
+	WindowSuppressed int64
+}
+
+// HitRatio returns the ratio of the suppressed records to the records
+// checked for duplication in the last HitRatioWindow.
+// It returns 0 if no record was checked.
+func (s Stats) HitRatio() float64 {
+	if s.WindowChecked == 0 {
+		return 0
+	}
+	return float64(s.WindowSuppressed) / float64(s.WindowChecked)
+}
+
+const hitWindowBuckets = 10
+
+// hitWindow counts the records in a sliding window
+// divided into hitWindowBuckets buckets.
+type hitWindow struct {
+	width      time.Duration
+	ids        [hitWindowBuckets]int64
+	checked    [hitWindowBuckets]int64
+	suppressed [hitWindowBuckets]int64
+}
+
+func newHitWindow(window time.Duration) hitWindow {
+	return hitWindow{width: max(window/hitWindowBuckets, 1)}
+}
+
+func (w *hitWindow) record(now time.Time, suppressed bool) {
+	id := now.UnixNano() / int64(w.width)
+	i := id % hitWindowBuckets
+	if w.ids[i] != id {
+		w.ids[i] = id
+		w.checked[i] = 0
+		w.suppressed[i] = 0
+	}
+	w.checked[i] += 1
+	if suppressed {
+		w.suppressed[i] += 1
+	}
+}
+
+func (w *hitWindow) sum(now time.Time) (int64, int64) {
+	id := now.UnixNano() / int64(w.width)
+	var checked, suppressed int64
+	for i := range w.ids {
+		if w.checked[i] > 0 && id-w.ids[i] < hitWindowBuckets {
+			checked += w.checked[i]
+			suppressed += w.suppressed[i]
+		}
+	}
+	return checked, suppressed
+}
+
+func newStats() Stats {
+	return Stats{
+		SuppressedByLevel: make(map[slog.Level]int64),
+	}
+}
+
+// Stats returns a snapshot of the counters, which are shared with
+// the handlers derived by WithAttrs or WithGroup.
+func (h *DedupHandler) Stats() Stats {
+	h.lock()
+	defer h.unlock()
+	s := h.stats
+	s.Name = h.opts.Name
+	s.SuppressedByLevel = maps.Clone(h.stats.SuppressedByLevel)
+	s.WindowChecked, s.WindowSuppressed = h.hits.sum(h.now())
+	return s
+}
@@ -0,0 +1,88 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsSuppressedByLevel(t *testing.T) {
+	h := NewDedupHandler(context.Background(),
+		slog.NewJSONHandler(new(bytes.Buffer), &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		}),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+	logger := slog.New(h)
+
+	for i := 0; i < 4; i++ {
+		logger.Debug("debug")
+	}
+	for i := 0; i < 3; i++ {
+		logger.Info("info")
+	}
+
+	stats := h.Stats()
+	assert.Equal(t, int64(2), stats.Emitted)
+	assert.Equal(t, int64(5), stats.Suppressed)
+	assert.Equal(t, map[slog.Level]int64{
+		slog.LevelDebug: 3,
+		slog.LevelInfo:  2,
+	}, stats.SuppressedByLevel)
+}
+
+func TestStatsHitRatio(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(new(bytes.Buffer), nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Hour,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			HitRatioWindow:         time.Minute,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	assert.Zero(t, h.Stats().HitRatio())
+
+	// 1 emitted and 3 suppressed.
+	for i := 0; i < 4; i++ {
+		logger.Info("test1")
+	}
+	assert.InDelta(t, 0.75, h.Stats().HitRatio(), 0.001)
+
+	// The old records go out of the window.
+	now = now.Add(time.Minute * 2)
+	logger.Info("test2")
+	logger.Info("test3")
+	logger.Info("test1")
+	stats := h.Stats()
+	assert.Equal(t, int64(3), stats.WindowChecked)
+	assert.InDelta(t, 1.0/3, stats.HitRatio(), 0.001)
+}
+
+func TestStatsFiltered(t *testing.T) {
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(new(bytes.Buffer), nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+		})
+
+	// slog.Logger checks Enabled first, but Handle may be called directly.
+	for i := 0; i < 3; i++ {
+		err := h.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelDebug, "debug", 0))
+		assert.NoError(t, err)
+	}
+	err := h.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "info", 0))
+	assert.NoError(t, err)
+
+	stats := h.Stats()
+	assert.Equal(t, int64(3), stats.Filtered)
+	assert.Equal(t, int64(1), stats.Emitted)
+	assert.Equal(t, int64(0), stats.Suppressed)
+}
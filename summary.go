@@ -0,0 +1,190 @@
+package deduplog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+const (
+	SuppressedCountKey = "dedup_suppressed"
+	SummaryValuesKey   = "dedup_values"
+	SummaryLevelsKey   = "dedup_levels"
+	SummaryExamplesKey = "dedup_examples"
+)
+
+// DefaultSummaryFormatter is the default SummaryFormatter.
+func DefaultSummaryFormatter(msg string, count int, firstSeen, lastSeen time.Time) string {
+	return fmt.Sprintf("suppressed %d duplicate messages: %s", count, msg)
+}
+
+// recordSuppressed accumulates the suppressed record r into e for the summary.
+func (h *DedupHandler) recordSuppressed(e *HistoryEntry, r slog.Record) {
+	now := h.now()
+	if e.pending == 0 {
+		e.firstSuppressed = now
+	}
+	e.lastSuppressed = now
+	e.pending += 1
+	if h.opts.SummarizeLevels {
+		if i, found := slices.BinarySearch(e.levels, r.Level); !found {
+			e.levels = slices.Insert(e.levels, i, r.Level)
+		}
+	}
+	if len(e.examples) < h.opts.SummaryExamples && !slices.Contains(e.examples, r.Message) {
+		e.examples = append(e.examples, r.Message)
+	}
+	if h.opts.SummarizeAttr == "" || len(e.values) >= h.opts.MaxSummaryValues {
+		return
+	}
+	v, ok := findAttr(r, h.opts.SummarizeAttr)
+	if !ok {
+		return
+	}
+	if s := v.String(); !slices.Contains(e.values, s) {
+		e.values = append(e.values, s)
+	}
+}
+
+// pendingSummary is a summary record whose message is not built yet,
+// so that SummaryFormatter is called without the lock held.
+type pendingSummary struct {
+	r         slog.Record
+	msg       string
+	count     int
+	firstSeen time.Time
+	lastSeen  time.Time
+	// formatter builds the message if SummaryFormatter is nil.
+	formatter func(msg string, count int, firstSeen, lastSeen time.Time) string
+}
+
+// summaryRecord returns the summary record with the message built by
+// SummaryFormatter, or by s.formatter, and CountInMessage.
+func (h *DedupHandler) summaryRecord(s pendingSummary) slog.Record {
+	var msg string
+	switch {
+	case h.opts.SummaryFormatter != nil:
+		msg = h.opts.SummaryFormatter(s.msg, s.count, s.firstSeen, s.lastSeen)
+	case h.opts.CountInMessage:
+		msg = s.msg
+	default:
+		msg = s.formatter(s.msg, s.count, s.firstSeen, s.lastSeen)
+	}
+	if h.opts.CountInMessage {
+		msg += fmt.Sprintf(" (x%d)", s.count)
+	}
+	r := s.r
+	r.Message = msg
+	return r
+}
+
+// queueSummary queues the summary record of e if it has suppressed records,
+// and resets them. It must be called with the lock held.
+func (h *DedupHandler) queueSummary(e *HistoryEntry) {
+	if !h.opts.EmitSummary || e.pending == 0 || e.synthetic {
+		return
+	}
+	r := h.newSyntheticRecord(h.now(), e.level, "")
+	if !h.opts.CountInMessage {
+		r.AddAttrs(slog.Uint64(SuppressedCountKey, e.pending))
+	}
+	if h.opts.SummarizeAttr != "" {
+		r.AddAttrs(slog.Any(SummaryValuesKey, e.values))
+	}
+	if h.opts.SummarizeLevels {
+		levels := make([]string, len(e.levels))
+		for i, l := range e.levels {
+			levels[i] = l.String()
+		}
+		r.AddAttrs(slog.Any(SummaryLevelsKey, levels))
+	}
+	if h.opts.SummaryExamples > 0 {
+		r.AddAttrs(slog.Any(SummaryExamplesKey, e.examples))
+	}
+	h.summaries = append(h.summaries, pendingSummary{
+		r:         r,
+		msg:       e.msg,
+		count:     int(e.pending),
+		firstSeen: e.firstSuppressed,
+		lastSeen:  e.lastSuppressed,
+		formatter: DefaultSummaryFormatter,
+	})
+	e.pending = 0
+	e.values = nil
+	e.levels = nil
+	e.examples = nil
+}
+
+// drain emits the pending summaries of all the keys, the one of the run of
+// ConsecutiveOnly, and the counts.
+func (h *DedupHandler) drain(ctx context.Context) {
+	h.lock()
+	h.history.Range(func(_ string, e *HistoryEntry) bool {
+		h.queueSummary(e)
+		return true
+	})
+	if s := h.runSummary(); s != nil {
+		h.summaries = append(h.summaries, *s)
+	}
+	h.unlock()
+	_ = h.flushCounts(ctx)
+	_ = h.flushSummaries(ctx)
+}
+
+// flushSummaries passes the queued summary records to the wrapped handler of
+// the root. The queue is shared with the derived handlers, so emitting them
+// through h would give the summaries of the other keys the attributes and
+// the groups of h.
+func (h *DedupHandler) flushSummaries(ctx context.Context) error {
+	root := h.root
+	h.lock()
+	summaries := h.summaries
+	h.summaries = nil
+	h.unlock()
+
+	var errs []error
+	for _, s := range summaries {
+		r := h.summaryRecord(s)
+		if h.opts.DedupSyntheticRecords && root.syntheticDuplicated(ctx, r) {
+			continue
+		}
+		if err := root.emit(ctx, r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// syntheticDuplicated reports whether the synthetic record r is
+// a duplicate. If not, r is recorded in the history.
+func (h *DedupHandler) syntheticDuplicated(ctx context.Context, r slog.Record) bool {
+	key := h.key(r)
+	eligible := h.dedupEligible(ctx, r)
+	h.lock()
+	defer h.unlock()
+	if eligible {
+		if _, dup := h.lookupDuplicate(key, r); dup {
+			return true
+		}
+	}
+	e, _ := h.touchHistory(key)
+	e.synthetic = true
+	e.level = r.Level
+	return false
+}
+
+func findAttr(r slog.Record, key string) (slog.Value, bool) {
+	var v slog.Value
+	found := false
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == key {
+			v, found = a.Value, true
+			return false
+		}
+		return true
+	})
+	return v, found
+}
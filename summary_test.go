@@ -0,0 +1,434 @@
+package deduplog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarizeAttr(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			EmitSummary:            true,
+			SummarizeAttr:          "user",
+			MaxSummaryValues:       2,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	logger.Info("test", "user", "alice")
+	for _, user := range []string{"bob", "carol", "bob", "dave"} {
+		logger.Info("test", "user", user)
+	}
+	assert.Equal(t, 1, bytes.Count(b.Bytes(), []byte("\n")))
+
+	// The summary is emitted before the next emission.
+	b.Reset()
+	now = now.Add(time.Minute * 2)
+	logger.Info("test", "user", "eve")
+	lines := bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	summary := make(map[string]any)
+	err := json.Unmarshal(lines[0], &summary)
+	require.NoError(t, err)
+	assert.Equal(t, "suppressed 4 duplicate messages: test", summary["msg"])
+	assert.Equal(t, float64(4), summary[SuppressedCountKey])
+	assert.Equal(t, []any{"bob", "carol"}, summary[SummaryValuesKey])
+
+	jsonLog := make(map[string]any)
+	err = json.Unmarshal(lines[1], &jsonLog)
+	require.NoError(t, err)
+	assert.Equal(t, "eve", jsonLog["user"])
+}
+
+func TestSummarizeLevels(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			DedupLogLevel:          slog.LevelWarn,
+			EmitSummary:            true,
+			SummarizeLevels:        true,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	logger.Info("test")
+	logger.Warn("test")
+	logger.Info("test")
+	logger.Warn("test")
+	assert.Equal(t, 1, bytes.Count(b.Bytes(), []byte("\n")))
+
+	b.Reset()
+	now = now.Add(time.Minute * 2)
+	logger.Info("test")
+	lines := bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	summary := make(map[string]any)
+	err := json.Unmarshal(lines[0], &summary)
+	require.NoError(t, err)
+	assert.Equal(t, "suppressed 3 duplicate messages: test", summary["msg"])
+	assert.Equal(t, []any{"INFO", "WARN"}, summary[SummaryLevelsKey])
+}
+
+func TestSummaryExamples(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			EmitSummary:            true,
+			MaskDigits:             true,
+			SummaryExamples:        2,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	for _, msg := range []string{"retry 1", "retry 2", "retry 2", "retry 3", "retry 4"} {
+		logger.Info(msg)
+	}
+	assert.Equal(t, 1, bytes.Count(b.Bytes(), []byte("\n")))
+
+	b.Reset()
+	now = now.Add(time.Minute * 2)
+	logger.Info("retry 5")
+	lines := bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	summary := make(map[string]any)
+	err := json.Unmarshal(lines[0], &summary)
+	require.NoError(t, err)
+	assert.Equal(t, float64(4), summary[SuppressedCountKey])
+	assert.Equal(t, []any{"retry 2", "retry 3"}, summary[SummaryExamplesKey])
+}
+
+func TestSummaryOnCleanup(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			EmitSummary:            true,
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	logger.Info("test1")
+	logger.Info("test1")
+	logger.Info("test2")
+
+	// Only the message with suppressed records is summarized.
+	b.Reset()
+	now = now.Add(time.Minute * 2)
+	h.removeExpiredHistory()
+	require.NoError(t, h.flushSummaries(context.Background()))
+	summary := make(map[string]any)
+	err := json.Unmarshal(b.Bytes(), &summary)
+	require.NoError(t, err)
+	assert.Equal(t, "suppressed 1 duplicate messages: test1", summary["msg"])
+	assert.Equal(t, float64(1), summary[SuppressedCountKey])
+	assert.NotContains(t, summary, SummaryValuesKey)
+}
+
+func TestSummaryThroughDerivedHandler(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CleanupInterval:        time.Hour,
+			EmitSummary:            true,
+		})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+	logger := slog.New(h)
+
+	logger.Info("b")
+	logger.Info("b")
+	clock.Advance(time.Minute * 2)
+	h.removeExpiredHistory()
+
+	// The summary of "b" is emitted by the next record, but without the
+	// attributes and the groups of the derived handler logging it.
+	b.Reset()
+	logger.WithGroup("req").With("request_id", "r-42").Info("c")
+	lines := bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	summary := make(map[string]any)
+	require.NoError(t, json.Unmarshal(lines[0], &summary))
+	assert.Equal(t, "suppressed 1 duplicate messages: b", summary["msg"])
+	assert.Equal(t, float64(1), summary[SuppressedCountKey])
+	assert.NotContains(t, summary, "req")
+	assert.Contains(t, string(lines[1]), `"msg":"c","req":{"request_id":"r-42"}`)
+}
+
+func TestSummaryFormatter(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			EmitSummary:            true,
+			SummaryFormatter: func(msg string, count int, firstSeen, lastSeen time.Time) string {
+				return fmt.Sprintf("%s x%d in %v", msg, count, lastSeen.Sub(firstSeen))
+			},
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	logger.Info("test")
+	now = now.Add(time.Second)
+	logger.Info("test")
+	now = now.Add(time.Second * 3)
+	logger.Info("test")
+
+	b.Reset()
+	now = now.Add(time.Minute * 2)
+	logger.Info("test")
+	lines := bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	summary := make(map[string]any)
+	err := json.Unmarshal(lines[0], &summary)
+	require.NoError(t, err)
+	assert.Equal(t, "test x2 in 3s", summary["msg"])
+}
+
+func TestSummaryFormatterLogging(t *testing.T) {
+	ch := newCountingHandler()
+	var logger *slog.Logger
+	h := NewDedupHandler(context.Background(), ch,
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CleanupInterval:        time.Hour,
+			EmitSummary:            true,
+			SummaryFormatter: func(msg string, count int, firstSeen, lastSeen time.Time) string {
+				// The formatter may log through the handler.
+				logger.Info("formatting " + msg)
+				return DefaultSummaryFormatter(msg, count, firstSeen, lastSeen)
+			},
+		})
+	defer h.Close()
+	logger = slog.New(h)
+
+	logger.Info("test")
+	logger.Info("test")
+	done := make(chan struct{})
+	go func() {
+		h.Flush("test")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Flush deadlocked")
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	assert.Equal(t, 1, ch.counts["formatting test"])
+	assert.Equal(t, 1, ch.counts["suppressed 1 duplicate messages: test"])
+}
+
+func TestDedupSyntheticRecords(t *testing.T) {
+	for _, dedupSynthetic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DedupSyntheticRecords=%t", dedupSynthetic), func(t *testing.T) {
+			b := new(bytes.Buffer)
+			h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+				&HandlerOptions{
+					HistoryRetentionPeriod: time.Minute,
+					MaxHistoryCount:        DefaultMaxHistoryCount,
+					ScopeAttr:              "id",
+					EmitSummary:            true,
+					DedupSyntheticRecords:  dedupSynthetic,
+				})
+			now := time.Now()
+			h.now = func() time.Time { return now }
+			logger := slog.New(h)
+
+			// The summaries for the two scopes have the same message.
+			for _, id := range []string{"1", "2"} {
+				logger.Info("test", "id", id)
+				logger.Info("test", "id", id)
+			}
+			b.Reset()
+			now = now.Add(time.Minute * 2)
+			h.removeExpiredHistory()
+			require.NoError(t, h.flushSummaries(context.Background()))
+			summaryCount := bytes.Count(b.Bytes(), []byte("suppressed 1 duplicate messages: test"))
+			if dedupSynthetic {
+				assert.Equal(t, 1, summaryCount)
+			} else {
+				assert.Equal(t, 2, summaryCount)
+			}
+		})
+	}
+}
+
+func TestHandlerName(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			EmitSummary:            true,
+			Name:                   "handler1",
+		})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	logger := slog.New(h)
+
+	logger.Info("test")
+	logger.Info("test")
+	jsonLog := make(map[string]any)
+	err := json.Unmarshal(b.Bytes(), &jsonLog)
+	require.NoError(t, err)
+	assert.NotContains(t, jsonLog, HandlerNameKey)
+
+	b.Reset()
+	now = now.Add(time.Minute * 2)
+	h.removeExpiredHistory()
+	require.NoError(t, h.flushSummaries(context.Background()))
+	summary := make(map[string]any)
+	err = json.Unmarshal(b.Bytes(), &summary)
+	require.NoError(t, err)
+	assert.Equal(t, "handler1", summary[HandlerNameKey])
+
+	assert.Equal(t, "handler1", h.Stats().Name)
+}
+
+func TestFlush(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewJSONHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			EmitSummary:            true,
+		})
+	logger := slog.New(h)
+
+	for i := 0; i < 4; i++ {
+		logger.Info("test")
+	}
+
+	b.Reset()
+	count, existed := h.Flush("test")
+	assert.True(t, existed)
+	assert.Equal(t, 3, count)
+	summary := make(map[string]any)
+	err := json.Unmarshal(b.Bytes(), &summary)
+	require.NoError(t, err)
+	assert.Equal(t, "suppressed 3 duplicate messages: test", summary["msg"])
+	assert.NotContains(t, h.history, "test")
+
+	count, existed = h.Flush("test")
+	assert.False(t, existed)
+	assert.Zero(t, count)
+
+	// The flushed message is emitted again.
+	b.Reset()
+	logger.Info("test")
+	assert.Contains(t, b.String(), `"msg":"test"`)
+}
+
+func TestCountInMessage(t *testing.T) {
+	b := new(bytes.Buffer)
+	h := NewDedupHandler(context.Background(), slog.NewTextHandler(b, nil),
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Minute,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			EmitSummary:            true,
+			CountInMessage:         true,
+		})
+	logger := slog.New(h)
+
+	for i := 0; i < 4; i++ {
+		logger.Info("disk full")
+	}
+	b.Reset()
+	h.Flush("disk full")
+
+	assert.Contains(t, b.String(), `msg="disk full (x3)"`)
+	assert.NotContains(t, b.String(), SuppressedCountKey)
+}
+
+func TestFlushOnShutdown(t *testing.T) {
+	for _, unsynchronized := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unsynchronized=%t", unsynchronized), func(t *testing.T) {
+			b := new(bytes.Buffer)
+			ch := newCountingHandler()
+			ctx, cancel := context.WithCancel(context.Background())
+			h := NewDedupHandler(ctx, ch,
+				&HandlerOptions{
+					HistoryRetentionPeriod: time.Hour,
+					MaxHistoryCount:        DefaultMaxHistoryCount,
+					CleanupInterval:        time.Hour,
+					EmitSummary:            true,
+					CountInMessage:         true,
+					CountStreamHandler:     slog.NewJSONHandler(b, nil),
+					FlushOnShutdown:        true,
+					Unsynchronized:         unsynchronized,
+				})
+			logger := slog.New(h)
+			for i := 0; i < 3; i++ {
+				logger.Info("foo")
+				logger.Info("bar")
+			}
+			logger.Info("baz")
+
+			if unsynchronized {
+				require.NoError(t, h.Close())
+			}
+			cancel()
+			require.Eventually(t, func() bool {
+				ch.mu.Lock()
+				defer ch.mu.Unlock()
+				return ch.counts["foo (x2)"] == 1 && ch.counts["bar (x2)"] == 1
+			}, time.Second, time.Millisecond)
+			assert.Contains(t, b.String(), `"key":"foo","delta":2`)
+		})
+	}
+}
+
+func TestFlushOnShutdownClose(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch,
+		&HandlerOptions{
+			HistoryRetentionPeriod: time.Hour,
+			MaxHistoryCount:        DefaultMaxHistoryCount,
+			CleanupInterval:        time.Hour,
+			EmitSummary:            true,
+			CountInMessage:         true,
+			FlushOnShutdown:        true,
+			AsyncEmit:              true,
+		})
+	logger := slog.New(h)
+	for i := 0; i < 3; i++ {
+		logger.Info("foo")
+	}
+
+	// The summary is emitted by the background cleanup, and Close waits
+	// for it.
+	require.NoError(t, h.Close())
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	assert.Equal(t, map[string]int{"foo": 1, "foo (x2)": 1}, ch.counts)
+}
@@ -0,0 +1,59 @@
+package deduplog
+
+import "log/slog"
+
+// tenantValue returns the value of the TenantAttr attribute in r,
+// or in the attributes given by WithAttrs if r does not have it.
+func (h *DedupHandler) tenantValue(r slog.Record) (string, bool) {
+	if h.opts.TenantAttr == "" {
+		return "", false
+	}
+	if v, ok := findAttr(r, h.opts.TenantAttr); ok {
+		return v.String(), true
+	}
+	return h.tenant, h.hasTenant
+}
+
+// reserveTenant evicts the keys of tenant until a new key of it fits in
+// MaxHistoryCountPerTenant. It must be called with the lock held.
+func (h *DedupHandler) reserveTenant(tenant string) {
+	if h.tenantCounts == nil {
+		return
+	}
+	for h.tenantCounts[tenant] >= h.opts.MaxHistoryCountPerTenant {
+		var oldestKey string
+		var oldest *HistoryEntry
+		h.history.Range(func(k string, v *HistoryEntry) bool {
+			if v.hasTenant && v.tenant == tenant && (oldest == nil || h.evictBefore(v, oldest)) {
+				oldestKey = k
+				oldest = v
+			}
+			return true
+		})
+		if oldest == nil {
+			// The counts are stale, e.g. after Reset.
+			delete(h.tenantCounts, tenant)
+			return
+		}
+		h.deleteHistory(oldestKey, oldest)
+		h.metrics.IncEvicted()
+	}
+}
+
+// setTenant assigns e to tenant. It must be called with the lock held.
+func (h *DedupHandler) setTenant(e *HistoryEntry, tenant string) {
+	e.tenant, e.hasTenant = tenant, true
+	h.countTenant(e, 1)
+}
+
+// countTenant adds delta to the number of the keys of the tenant of e.
+// It must be called with the lock held.
+func (h *DedupHandler) countTenant(e *HistoryEntry, delta int) {
+	if h.tenantCounts == nil || !e.hasTenant {
+		return
+	}
+	h.tenantCounts[e.tenant] += delta
+	if h.tenantCounts[e.tenant] <= 0 {
+		delete(h.tenantCounts, e.tenant)
+	}
+}
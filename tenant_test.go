@@ -0,0 +1,58 @@
+package deduplog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantAttr(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod:   time.Minute,
+		MaxHistoryCount:          DefaultMaxHistoryCount,
+		TenantAttr:               "tenant",
+		MaxHistoryCountPerTenant: 2,
+	})
+	defer h.Close()
+	logger := slog.New(h)
+	a := func(msg string) { logger.Info(msg, "tenant", "a") }
+	b := func(msg string) { logger.Info(msg, "tenant", "b") }
+
+	// The tenants are deduplicated independently.
+	a("foo")
+	b("foo")
+	a("foo")
+	b("foo")
+	assert.Equal(t, 2, ch.counts["foo"])
+
+	// The noisy tenant evicts only its own keys.
+	for i := 0; i < 10; i++ {
+		a(fmt.Sprintf("noise %d", i))
+	}
+	b("foo")
+	assert.Equal(t, 2, ch.counts["foo"])
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, h.tenantCounts)
+	assert.Equal(t, 3, historyLen(h))
+
+	// The latest keys of the noisy tenant are kept.
+	a("noise 8")
+	a("noise 9")
+	assert.Equal(t, 1, ch.counts["noise 8"])
+	assert.Equal(t, 1, ch.counts["noise 9"])
+	a("foo")
+	assert.Equal(t, 3, ch.counts["foo"])
+
+	// The tenant can be set by WithAttrs.
+	ctx := context.Background()
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, "foo", 0)
+	derived := h.WithAttrs([]slog.Attr{slog.String("tenant", "b")}).(*DedupHandler)
+	tr := r.Clone()
+	tr.AddAttrs(slog.String("tenant", "b"))
+	assert.Equal(t, h.KeyFor(ctx, tr), derived.KeyFor(ctx, r))
+	assert.NotEqual(t, h.KeyFor(ctx, r), derived.KeyFor(ctx, r))
+}
@@ -0,0 +1,49 @@
+package deduplog
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of the events. It has its own lock
+// because it is shared among the handlers derived from the same one.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full tokenBucket allowing rate events per
+// second. Up to rate events, but at least one, are allowed at once.
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	burst := max(math.Ceil(rate), 1)
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// allow consumes a token and reports whether one was available.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens = min(b.tokens+d.Seconds()*b.rate, b.burst)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+// allowEmit reports whether GlobalMaxEmitRate allows emitting a record.
+func (h *DedupHandler) allowEmit() bool {
+	return h.throttle == nil || h.throttle.allow(h.now())
+}
@@ -0,0 +1,60 @@
+package deduplog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobalMaxEmitRate(t *testing.T) {
+	ch := newCountingHandler()
+	h := NewDedupHandler(context.Background(), ch, &HandlerOptions{
+		HistoryRetentionPeriod: time.Minute,
+		MaxHistoryCount:        DefaultMaxHistoryCount,
+		GlobalMaxEmitRate:      10,
+	})
+	defer h.Close()
+	clock := newFakeClock()
+	setClock(h, clock)
+	h.throttle.last = clock.Now()
+	child := h.WithAttrs([]slog.Attr{slog.String("component", "child")}).(*DedupHandler)
+
+	emitted := func(round int) int {
+		n := 0
+		for i := 0; i < 100; i++ {
+			handler := h
+			if i%2 == 1 {
+				handler = child
+			}
+			r := slog.NewRecord(clock.Now(), slog.LevelInfo, fmt.Sprintf("message %d-%d", round, i), 0)
+			ok, reason, err := handler.HandleReport(context.Background(), r)
+			require.NoError(t, err)
+			if ok {
+				n++
+			} else {
+				assert.Equal(t, ReasonThrottled, reason)
+			}
+		}
+		return n
+	}
+
+	// The handlers derived from h share the limit.
+	assert.Equal(t, 10, emitted(0))
+	assert.Equal(t, int64(90), h.Stats().Throttled)
+
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, 5, emitted(1))
+
+	// The throttled records are not in the history.
+	clock.Advance(time.Second)
+	r := slog.NewRecord(clock.Now(), slog.LevelInfo, "message 1-98", 0)
+	ok, reason, err := h.HandleReport(context.Background(), r)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, ReasonEmitted, reason)
+}